@@ -1,5 +1,7 @@
 package cfg
 
 type Index struct {
-	MaxSizeByte uint64
+	MaxSizeByte  uint64
+	StartOffset  uint64
+	IntervalByte uint64 // bytes of messages between sparse index entries. Zero indexes every message
 }
@@ -1,6 +1,14 @@
 package cfg
 
+import "time"
+
 type Partition struct {
 	Dir string
 	Segment
+	RetentionByte          uint64        // max message bytes kept across segments. Zero keeps everything
+	RetentionAge           time.Duration // max age of a segment's newest message. Zero keeps everything
+	RetentionCheckInterval time.Duration // how often the background cleaner enforces retention. Zero disables it
+	Compact                bool          // keep only the latest message per key in closed segments
+	CompactionInterval     time.Duration // how often the background cleaner compacts. Zero disables it
+	TombstoneRetention     time.Duration // how long a message with an empty value survives compaction
 }
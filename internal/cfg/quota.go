@@ -0,0 +1,8 @@
+package cfg
+
+// Quota limits the bytes of messages kept on disk. Appends are rejected once a limit is reached.
+type Quota struct {
+	TopicBytes  uint64            // default limit of every topic. Zero means unlimited
+	Topics      map[string]uint64 // limits of individual topics, overriding TopicBytes
+	GlobalBytes uint64            // limit of all topics together. Zero means unlimited
+}
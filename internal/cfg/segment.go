@@ -1,7 +1,25 @@
 package cfg
 
+import "time"
+
+type SyncPolicy int
+
+const (
+	SyncOS       SyncPolicy = iota // appended messages are handed to the OS, which decides when to flush them
+	SyncAlways                     // every append is fsynced before it returns
+	SyncEveryN                     // appends are fsynced once SyncEveryMessages have accumulated
+	SyncInterval                   // appends are fsynced in the background every SyncInterval
+)
+
 type Segment struct {
-	MaxIdxSizeByte uint64
-	MaxMsgSizeByte uint64
-	StartOffset    uint64
+	MaxIdxSizeByte     uint64
+	MaxTimeIdxSizeByte uint64 // defaults to MaxIdxSizeByte when zero
+	MaxMsgSizeByte     uint64
+	StartOffset        uint64
+	IdxIntervalByte    uint64 // see Index.IntervalByte
+	SyncPolicy         SyncPolicy
+	SyncEveryMessages  uint64
+	SyncInterval       time.Duration
+	MaxAge             time.Duration // a segment is rolled once it has been open this long, zero disables
+	MaxIdle            time.Duration // a segment is rolled once nothing was appended to it for this long, zero disables
 }
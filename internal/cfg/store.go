@@ -1,6 +1,15 @@
 package cfg
 
+import "time"
+
 type Store struct {
-	Consumer  Consumer
-	Partition Partition
+	Consumer   Consumer
+	Partition  Partition
+	Partitions int // partitions of a topic created on first use. Defaults to 1
+	Quota      Quota
+	Tiering    Tiering
+	// RecordCacheBytes bounds the records cached in memory for the partitions to share. Zero disables the cache
+	RecordCacheBytes uint64
+	// TransactionTimeout is how long a transaction may stay open before it is aborted. Zero never aborts one
+	TransactionTimeout time.Duration
 }
@@ -0,0 +1,11 @@
+package cfg
+
+import "time"
+
+type Tiering struct {
+	RemoteDir         string        // directory of the remote store a FileEngine offloads to. Empty disables tiering there
+	LocalRetention    time.Duration // closed segments whose newest message is older than this are offloaded
+	CheckInterval     time.Duration // how often closed segments are offloaded in the background. Zero disables it
+	CacheDir          string        // where offloaded segments are fetched back to when read
+	MaxCachedSegments int           // fetched segments kept in CacheDir before the least recently used is evicted
+}
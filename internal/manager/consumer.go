@@ -6,69 +6,42 @@ import (
 	"github.com/vandathron/bcaster/internal/cfg"
 	"github.com/vandathron/bcaster/internal/model"
 	"github.com/vandathron/bcaster/internal/storage"
-	"io"
-	"os"
-	"path"
-	"path/filepath"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
 )
 
 type Consumer struct {
-	consumers       []*storage.Consumer
+	consumers       []storage.OffsetStore
 	topicToConsumer map[string][]*model.Consumer
-	cfg             cfg.Consumer
-	activeConsumer  *storage.Consumer
+	offsets         storage.OffsetStorage
+	activeConsumer  storage.OffsetStore
 	lock            sync.Mutex
 	cOffLock        sync.Mutex
 }
 
+// NewConsumerMgr loads the consumers kept in the <base offset>.consumer files of cfg.Dir.
 func NewConsumerMgr(cfg cfg.Consumer) (*Consumer, error) {
+	return NewConsumerMgrWithStorage(storage.NewConsumerDir(cfg))
+}
 
-	if cfg.MaxSizeByte == 0 || cfg.MaxSizeByte < 1024*70 { // 70kb
-		cfg.MaxSizeByte = (1024 * 1024) / 0.5 // 0.5mb
-	}
-
-	m := &Consumer{cfg: cfg}
-	consumerFiles, err := os.ReadDir(m.cfg.Dir)
+// NewConsumerMgrWithStorage loads the consumers kept in the offset stores of offsets.
+func NewConsumerMgrWithStorage(offsets storage.OffsetStorage) (*Consumer, error) {
+	m := &Consumer{offsets: offsets}
+	stores, err := offsets.OpenOffsetStores()
 	if err != nil {
 		return nil, err
 	}
 
-	sort.Slice(consumerFiles, func(i, j int) bool {
-		parse := func(name string) int {
-			i, _ := strconv.Atoi(strings.TrimSuffix(name, path.Ext(name)))
-			return i
-		}
-		return parse(consumerFiles[i].Name()) < parse(consumerFiles[j].Name())
-	})
-
 	m.topicToConsumer = make(map[string][]*model.Consumer)
-	for _, file := range consumerFiles {
-		if file.IsDir() || path.Ext(file.Name()) != ".consumer" {
-			continue
-		}
-		baseOff, _ := strconv.Atoi(strings.TrimSuffix(file.Name(), path.Ext(file.Name())))
-		filePath := filepath.Join(m.cfg.Dir, file.Name())
-		c, err := storage.NewConsumer(filePath, m.cfg.MaxSizeByte, uint32(baseOff))
-		if err != nil {
-			func() {
-				for _, consumer := range m.consumers {
-					_ = consumer.Close()
-				}
-			}()
-			return nil, err
-		}
-
-		for i := baseOff; ; i++ {
-			id, topic, readOff, err := c.Read(uint32(i), true)
+	for _, c := range stores {
+		for i := c.BaseOff(); ; i++ {
+			id, topic, readOff, err := c.Read(i, true)
 			if err != nil {
-				if err == io.EOF {
+				if errors.Is(err, storage.ErrConsumerNotFound) { // read past the last consumer in the file
 					break
 				}
-				_ = c.Close()
+				for _, c := range stores {
+					_ = c.Close()
+				}
 				return nil, err
 			}
 			topicStr := string(topic)
@@ -81,7 +54,7 @@ func NewConsumerMgr(cfg cfg.Consumer) (*Consumer, error) {
 				ID:         string(id),
 				Topic:      topicStr,
 				ReadOffset: readOff,
-				Off:        uint32(i),
+				Off:        i,
 			})
 		}
 		m.consumers = append(m.consumers, c)
@@ -89,7 +62,7 @@ func NewConsumerMgr(cfg cfg.Consumer) (*Consumer, error) {
 	}
 
 	if len(m.consumers) == 0 {
-		err := m.injectNewActiveConsumer("0.consumer", uint32(0))
+		err := m.injectNewActiveConsumer(uint32(0))
 		if err != nil {
 			return nil, err
 		}
@@ -114,9 +87,9 @@ func (m *Consumer) Add(consumer model.Consumer) error {
 
 	off, err := m.activeConsumer.Append([]byte(consumer.ID), []byte(consumer.Topic), consumer.ReadOffset)
 	if err != nil {
-		if err == io.EOF { // indicates activeConsumer is maxed out. get consumer's latest committed offset
+		if err == storage.ErrConsumerFileFull { // get consumer's latest committed offset
 			baseOff := m.activeConsumer.LatestCommitedOff() + 1
-			err = m.injectNewActiveConsumer(fmt.Sprintf("%v.consumer", baseOff), baseOff)
+			err = m.injectNewActiveConsumer(baseOff)
 			if err != nil {
 				return err
 			}
@@ -147,10 +120,9 @@ func (m *Consumer) Read(id, topic string) (readOff uint64, err error) {
 				return c.ReadOffset, nil
 			}
 		}
-		return 0, fmt.Errorf("consumer not found for topic: %s", topic)
 	}
 
-	return 0, fmt.Errorf("topic not found")
+	return 0, consumerNotFound(topic)
 }
 
 func (m *Consumer) ReadTopic(topic string) ([]model.Consumer, error) {
@@ -162,7 +134,7 @@ func (m *Consumer) ReadTopic(topic string) ([]model.Consumer, error) {
 		return c, nil
 	}
 
-	return nil, fmt.Errorf("topic not found")
+	return nil, fmt.Errorf("%w: %s", storage.ErrTopicNotFound, topic)
 }
 
 func (m *Consumer) Ack(id, topic string) error {
@@ -175,10 +147,34 @@ func (m *Consumer) Ack(id, topic string) error {
 				return nil
 			}
 		}
-		return fmt.Errorf("consumer not found for topic: %s", topic)
 	}
 
-	return fmt.Errorf("topic not found")
+	return consumerNotFound(topic)
+}
+
+// Seek moves a consumer's read offset to off and persists it.
+func (m *Consumer) Seek(id, topic string, off uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if consumers, ok := m.topicToConsumer[topic]; ok {
+		for _, c := range consumers {
+			if c.ID == id {
+				cs := m.consumerStoreByOffset(c.Off)
+				if cs == nil {
+					return fmt.Errorf("%w: %s for topic: %s", storage.ErrConsumerNotFound, id, topic)
+				}
+				if err := cs.WriteAt(c.Off, []byte(id), []byte(topic), off); err != nil {
+					return err
+				}
+				m.cOffLock.Lock()
+				c.ReadOffset = off
+				m.cOffLock.Unlock()
+				return nil
+			}
+		}
+	}
+
+	return consumerNotFound(topic)
 }
 
 func (m *Consumer) Remove(id, topic string) error {
@@ -189,7 +185,7 @@ func (m *Consumer) Remove(id, topic string) error {
 			if c.ID == id {
 				cs := m.consumerStoreByOffset(c.Off)
 				if cs == nil {
-					return fmt.Errorf("consumer %s not found for topic: %s", id, topic)
+					return fmt.Errorf("%w: %s for topic: %s", storage.ErrConsumerNotFound, id, topic)
 				}
 				err := cs.WriteAt(c.Off, []byte{}, []byte{}, c.ReadOffset)
 				if err != nil {
@@ -197,16 +193,15 @@ func (m *Consumer) Remove(id, topic string) error {
 				}
 				consumers = append(consumers[:i], consumers[i+1:]...)
 				m.topicToConsumer[topic] = consumers
-				//if len(consumers) == 0 {
-				//	delete(m.topicToConsumer, topic)
-				//}
+				if len(consumers) == 0 {
+					delete(m.topicToConsumer, topic)
+				}
 				return nil
 			}
 		}
-		return fmt.Errorf("consumer not found for topic: %s", topic)
 	}
 
-	return fmt.Errorf("topic not found")
+	return consumerNotFound(topic)
 }
 
 func (m *Consumer) Close() error {
@@ -223,9 +218,8 @@ func (m *Consumer) getConsumer(c *model.Consumer) model.Consumer {
 	return *c
 }
 
-func (m *Consumer) injectNewActiveConsumer(name string, baseOff uint32) error {
-	p := filepath.Join(m.cfg.Dir, name)
-	c, err := storage.NewConsumer(p, m.cfg.MaxSizeByte, baseOff)
+func (m *Consumer) injectNewActiveConsumer(baseOff uint32) error {
+	c, err := m.offsets.CreateOffsetStore(baseOff)
 	if err != nil {
 		return err
 	}
@@ -246,7 +240,39 @@ func (m *Consumer) validate(consumer model.Consumer) error {
 	return nil
 }
 
-func (m *Consumer) consumerStoreByOffset(off uint32) *storage.Consumer {
+// renameTopic moves the consumers of topic from to topic to, persisting their new topic.
+func (m *Consumer) renameTopic(from, to string) error {
+	if len(to) > storage.TopicSize {
+		return errors.New("topic exceeds allowed size")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for consumers := m.topicToConsumer[from]; len(consumers) > 0; consumers = m.topicToConsumer[from] {
+		c := consumers[0]
+		cs := m.consumerStoreByOffset(c.Off)
+		if cs == nil {
+			return fmt.Errorf("%w: %s for topic: %s", storage.ErrConsumerNotFound, c.ID, from)
+		}
+		m.cOffLock.Lock()
+		readOff := c.ReadOffset
+		m.cOffLock.Unlock()
+		if err := cs.WriteAt(c.Off, []byte(c.ID), []byte(to), readOff); err != nil {
+			return err
+		}
+		c.Topic = to
+		m.topicToConsumer[to] = append(m.topicToConsumer[to], c)
+		m.topicToConsumer[from] = consumers[1:]
+	}
+	delete(m.topicToConsumer, from)
+	return nil
+}
+
+// consumerNotFound reports a consumer missing from topic, which may have no consumers at all.
+func consumerNotFound(topic string) error {
+	return fmt.Errorf("%w for topic: %s", storage.ErrConsumerNotFound, topic)
+}
+
+func (m *Consumer) consumerStoreByOffset(off uint32) storage.OffsetStore {
 	if len(m.consumers) == 0 {
 		return nil
 	}
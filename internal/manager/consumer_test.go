@@ -67,7 +67,7 @@ func TestConsumerMgr_Subscribe(t *testing.T) {
 					Topic:      "user_created_" + strconv.Itoa(i),
 					ReadOffset: uint64(j + 1),
 				}
-				err = m.Add(c)
+				err := m.Add(c)
 				require.NoError(t, err)
 			}
 		}()
@@ -91,7 +91,7 @@ func TestConsumerMgr_Subscribe(t *testing.T) {
 	requireCommon(m)
 
 	// unsubscribe all consumers in user_created_1 topic
-	for i := 200; i < 300; i++ {
+	for i := 200; i < 400; i++ {
 		err := m.Remove("user_service_"+strconv.Itoa(i), "user_created_"+strconv.Itoa(1))
 		require.NoError(t, err)
 	}
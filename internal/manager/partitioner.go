@@ -0,0 +1,48 @@
+package manager
+
+import (
+	"fmt"
+	"github.com/vandathron/bcaster/internal/model"
+	"github.com/vandathron/bcaster/internal/storage"
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// Partitioner chooses which of a topic's partitions a message is appended to.
+type Partitioner interface {
+	Partition(msg model.Msg, partitions int) (int, error)
+}
+
+// KeyHashPartitioner sends messages with the same key to the same partition so they stay in order. Messages
+// without a key are spread round-robin.
+type KeyHashPartitioner struct {
+	keyless RoundRobinPartitioner
+}
+
+func (p *KeyHashPartitioner) Partition(msg model.Msg, partitions int) (int, error) {
+	if len(msg.Key) == 0 {
+		return p.keyless.Partition(msg, partitions)
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(msg.Key)
+	return int(h.Sum32() % uint32(partitions)), nil
+}
+
+// RoundRobinPartitioner spreads messages evenly across partitions regardless of their keys.
+type RoundRobinPartitioner struct {
+	next atomic.Uint64
+}
+
+func (p *RoundRobinPartitioner) Partition(_ model.Msg, partitions int) (int, error) {
+	return int((p.next.Add(1) - 1) % uint64(partitions)), nil
+}
+
+// ExplicitPartitioner sends every message to the partition it holds.
+type ExplicitPartitioner int
+
+func (p ExplicitPartitioner) Partition(_ model.Msg, partitions int) (int, error) {
+	if int(p) < 0 || int(p) >= partitions {
+		return 0, fmt.Errorf("%w: %d of %d partitions", storage.ErrPartitionNotFound, int(p), partitions)
+	}
+	return int(p), nil
+}
@@ -0,0 +1,42 @@
+package manager
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/vandathron/bcaster/internal/model"
+	"github.com/vandathron/bcaster/internal/storage"
+	"strconv"
+	"testing"
+)
+
+func TestPartitioners(t *testing.T) {
+	keyHash := &KeyHashPartitioner{}
+	seen := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		msg := model.Msg{Key: []byte("key_" + strconv.Itoa(i))}
+		partition, err := keyHash.Partition(msg, 4)
+		require.NoError(t, err)
+		again, err := keyHash.Partition(msg, 4)
+		require.NoError(t, err)
+		require.Equal(t, partition, again)
+		seen[partition] = true
+	}
+	require.Equal(t, 4, len(seen)) // keys are spread across every partition
+
+	roundRobin := &RoundRobinPartitioner{}
+	for i := 0; i < 6; i++ {
+		partition, err := roundRobin.Partition(model.Msg{Key: []byte("key")}, 3)
+		require.NoError(t, err)
+		require.Equal(t, i%3, partition)
+	}
+	for i := 0; i < 3; i++ { // keyless messages are spread round-robin by the key hash partitioner too
+		partition, err := keyHash.Partition(model.Msg{}, 3)
+		require.NoError(t, err)
+		require.Equal(t, i, partition)
+	}
+
+	partition, err := ExplicitPartitioner(2).Partition(model.Msg{}, 3)
+	require.NoError(t, err)
+	require.Equal(t, 2, partition)
+	_, err = ExplicitPartitioner(3).Partition(model.Msg{}, 3)
+	require.ErrorIs(t, err, storage.ErrPartitionNotFound)
+}
@@ -0,0 +1,67 @@
+package manager
+
+import (
+	"fmt"
+	"github.com/vandathron/bcaster/internal/model"
+	"github.com/vandathron/bcaster/internal/storage"
+)
+
+// InitProducer registers a new idempotent producer. It numbers the messages it appends to each partition
+// with sequence numbers starting at 0, so retries of a batch are only appended once.
+func (s *Store) InitProducer() (model.Producer, error) {
+	id, err := s.engine.NextProducerID()
+	if err != nil {
+		return model.Producer{}, err
+	}
+	return model.Producer{ID: id}, nil
+}
+
+// ReinitProducer registers a new instance of producer id, such as one restarted after a crash, under the next
+// epoch. Earlier epochs are fenced and a transaction they left open is aborted. The new instance numbers its
+// messages from 0 again.
+func (s *Store) ReinitProducer(id uint64) (model.Producer, error) {
+	s.txns.lock.Lock()
+	defer s.txns.lock.Unlock()
+	s.epochLock.Lock()
+	epoch, err := s.engine.BumpProducerEpoch(id)
+	s.epochLock.Unlock()
+	if err != nil {
+		return model.Producer{}, err
+	}
+	if t, ok := s.txns.states[id]; ok {
+		if err = s.endTransaction(id, t, model.ControlAbort); err != nil {
+			return model.Producer{}, err
+		}
+	}
+	return model.Producer{ID: id, Epoch: epoch}, nil
+}
+
+// AppendIdempotent writes msgs to partition of topic on behalf of producer, whose Sequence numbers the first
+// message, and returns the offsets of the first and last one. A retried batch returns the offsets it was
+// first appended at.
+func (s *Store) AppendIdempotent(producer model.Producer, topic string, partition int, msgs []model.Msg) (first, last uint64, err error) {
+	s.epochLock.RLock()
+	defer s.epochLock.RUnlock()
+	if err = s.checkEpoch(producer); err != nil {
+		return 0, 0, err
+	}
+	p, err := s.appendPartition(topic, partition)
+	if err != nil {
+		return 0, 0, err
+	}
+	return p.AppendIdempotent(producer, msgs)
+}
+
+// checkEpoch fails with an error wrapping storage.ErrProducerFenced when ReinitProducer registered a newer
+// epoch of producer.
+func (s *Store) checkEpoch(producer model.Producer) error {
+	epoch, err := s.engine.ProducerEpoch(producer.ID)
+	if err != nil {
+		return err
+	}
+	if producer.Epoch < epoch {
+		return fmt.Errorf("%w: producer %d epoch %d, current epoch %d", storage.ErrProducerFenced, producer.ID,
+			producer.Epoch, epoch)
+	}
+	return nil
+}
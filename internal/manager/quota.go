@@ -0,0 +1,116 @@
+package manager
+
+import (
+	"github.com/vandathron/bcaster/internal/storage"
+	"slices"
+)
+
+// QuotaUsage reports the bytes a topic, or the whole store when Topic is empty, keeps on disk against its
+// quota.
+type QuotaUsage struct {
+	Topic    string `json:"topic,omitempty"`
+	Used     uint64 `json:"used_bytes"`
+	Limit    uint64 `json:"limit_bytes"` // zero means unlimited
+	Exceeded bool   `json:"exceeded"`
+}
+
+func newQuotaUsage(topic string, used, limit uint64) QuotaUsage {
+	return QuotaUsage{Topic: topic, Used: used, Limit: limit, Exceeded: limit > 0 && used >= limit}
+}
+
+// Quotas returns the usage of the store and of each of its topics, sorted by name. Topics that were not
+// loaded yet are loaded to be measured.
+func (s *Store) Quotas() (global QuotaUsage, topics []QuotaUsage, err error) {
+	if err = s.loadTopics(); err != nil {
+		return QuotaUsage{}, nil, err
+	}
+
+	s.pLock.Lock()
+	defer s.pLock.Unlock()
+	names := make([]string, 0, len(s.topics))
+	for topic := range s.topics {
+		names = append(names, topic)
+	}
+	slices.Sort(names)
+
+	var total uint64
+	for _, topic := range names {
+		used := logsSize(s.topics[topic])
+		total += used
+		topics = append(topics, newQuotaUsage(topic, used, s.topicQuota(topic)))
+	}
+	return newQuotaUsage("", total, s.config.Quota.GlobalBytes), topics, nil
+}
+
+// appendPartition returns partition n of topic to append to, failing with a storage.QuotaExceededError once
+// the topic or the store reached its quota. The append reaching a quota is accepted, so usage may exceed a
+// quota by one batch.
+func (s *Store) appendPartition(topic string, n int) (storage.Log, error) {
+	partitions, err := s.partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n >= len(partitions) {
+		return nil, partitionNotFound(topic, n)
+	}
+	if err = s.checkQuota(topic, partitions); err != nil {
+		return nil, err
+	}
+	return partitions[n], nil
+}
+
+func (s *Store) checkQuota(topic string, partitions []storage.Log) error {
+	if limit := s.topicQuota(topic); limit > 0 {
+		if used := logsSize(partitions); used >= limit {
+			return &storage.QuotaExceededError{Topic: topic, Used: used, Limit: limit}
+		}
+	}
+	if limit := s.config.Quota.GlobalBytes; limit > 0 {
+		if used := s.usedBytes(); used >= limit {
+			return &storage.QuotaExceededError{Used: used, Limit: limit}
+		}
+	}
+	return nil
+}
+
+// topicQuota returns the quota of topic, zero when it is unlimited.
+func (s *Store) topicQuota(topic string) uint64 {
+	if limit, ok := s.config.Quota.Topics[topic]; ok {
+		return limit
+	}
+	return s.config.Quota.TopicBytes
+}
+
+// usedBytes returns the bytes the loaded topics keep on disk. Every topic is loaded when the store opens with
+// a global quota.
+func (s *Store) usedBytes() uint64 {
+	s.pLock.Lock()
+	defer s.pLock.Unlock()
+	var used uint64
+	for _, partitions := range s.topics {
+		used += logsSize(partitions)
+	}
+	return used
+}
+
+// loadTopics loads every topic of the engine that was not loaded yet.
+func (s *Store) loadTopics() error {
+	topics, err := s.engine.Topics()
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		if _, err = s.partitions(topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func logsSize(logs []storage.Log) uint64 {
+	var size uint64
+	for _, l := range logs {
+		size += l.Size()
+	}
+	return size
+}
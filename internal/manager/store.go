@@ -1,103 +1,306 @@
 package manager
 
 import (
+	"context"
+	"errors"
 	"github.com/vandathron/bcaster/internal/cfg"
 	"github.com/vandathron/bcaster/internal/model"
 	"github.com/vandathron/bcaster/internal/storage"
+	"math"
+	"sync"
 )
 
 type Store struct {
-	cMgr             *Consumer
-	topicToPartition map[string]*storage.Partition
-	config           cfg.Store
+	cMgr        *Consumer
+	topics      map[string][]storage.Log // partitions of each loaded topic, indexed by partition number
+	pLock       sync.Mutex               // guards topics
+	config      cfg.Store
+	partitioner Partitioner
+	engine      storage.Engine
+	txns        transactions
+	epochLock   sync.RWMutex // read by idempotent appends from checking the producer's epoch to appending, written to bump one
 }
 
+// NewStore opens a store keeping its data in the directories of config, failing with an error wrapping
+// storage.ErrDirLocked when another store has them open.
 func NewStore(config cfg.Store) (*Store, error) {
-	s := &Store{}
-	s.topicToPartition = make(map[string]*storage.Partition)
-	mgr, err := NewConsumerMgr(config.Consumer)
+	engine, err := storage.NewFileEngine(config)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewStoreWithEngine(config, engine)
+	if err != nil {
+		_ = engine.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewStoreWithEngine opens a store keeping its data in engine, which is closed along with the store. The
+// directories in config are not used.
+func NewStoreWithEngine(config cfg.Store, engine storage.Engine) (*Store, error) {
+	s := &Store{partitioner: &KeyHashPartitioner{}, engine: engine}
+	s.topics = make(map[string][]storage.Log)
+	mgr, err := NewConsumerMgrWithStorage(engine)
 	if err != nil {
 		return nil, err
 	}
 	s.cMgr = mgr
 	s.config = config
+	if err = s.recoverTransactions(); err == nil && config.Quota.GlobalBytes > 0 {
+		err = s.loadTopics() // measured by the global quota
+	}
+	if err != nil {
+		_ = s.cMgr.Close()
+		_ = s.closeLogs()
+		return nil, err
+	}
+	if config.TransactionTimeout > 0 {
+		s.txns.stop = make(chan struct{})
+		s.txns.background.Add(1)
+		go s.runTxnTimeouts()
+	}
 	return s, nil
 }
 
-func (s *Store) Read(c model.Consumer) (msg []byte, err error) {
-	readOff, err := s.cMgr.Read(c.ID, c.Topic)
+// Read returns the consumer's next message. Transaction markers are never returned, and read-committed
+// consumers skip aborted transactions and wait for open ones to end.
+func (s *Store) Read(c model.Consumer) (msg *model.Msg, err error) {
+	p, readOff, err := s.readPosition(c)
 	if err != nil {
 		return nil, err
 	}
 
-	p, ok := s.topicToPartition[c.Topic]
-	if !ok { // partition may have not been loaded or closed
-		p, err = storage.NewPartition(c.Topic, s.config.Partition)
+	msg, err = s.next(p, c, readOff)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if c.AutoCommit {
+		if msg.Offset != readOff { // skipped offsets removed by compaction or hidden from the consumer
+			if err = s.cMgr.Seek(c.ID, consumerTopic(c), msg.Offset); err != nil {
+				return nil, err
+			}
+		}
+		err = s.cMgr.Ack(c.ID, consumerTopic(c))
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+// ReadWait is like Read but blocks until a message is available for the consumer or ctx is done.
+func (s *Store) ReadWait(ctx context.Context, c model.Consumer) (*model.Msg, error) {
+	for {
+		p, err := s.partition(c.Topic, c.Partition)
+		if err != nil {
+			return nil, err
+		}
+		hwm := p.HighWatermark() // taken before reading so a transaction ending in between is not missed
+
+		msg, err := s.Read(c)
+		if !errors.Is(err, storage.ErrOffsetOutOfRange) {
+			return msg, err
+		}
 
+		_, readOff, err := s.readPosition(c)
 		if err != nil {
 			return nil, err
 		}
+		if err = p.WaitForOffset(ctx, max(readOff, hwm)); err != nil { // hidden messages wait for the next append
+			return nil, err
+		}
 	}
+}
 
-	msg, err = p.Read(readOff)
+// ReadBatch returns up to maxMessages messages for the consumer, bounded by maxBytes, hiding the messages Read
+// hides. With AutoCommit the consumer is moved past the last message returned.
+func (s *Store) ReadBatch(c model.Consumer, maxMessages int, maxBytes int) ([]*model.Msg, error) {
+	p, readOff, err := s.readPosition(c)
+	if err != nil {
+		return nil, err
+	}
 
+	msgs, next, err := s.nextBatch(p, c, readOff, maxMessages, maxBytes)
 	if err != nil {
 		return nil, err
 	}
 
 	if c.AutoCommit {
-		err = s.cMgr.Ack(c.ID, c.Topic)
+		if err = s.cMgr.Seek(c.ID, consumerTopic(c), next); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
 
+// next returns the first message at or after off the consumer may see.
+func (s *Store) next(p storage.Log, c model.Consumer, off uint64) (*model.Msg, error) {
+	end := readEnd(p, c)
+	for {
+		if off >= end {
+			return nil, &storage.OffsetOutOfRangeError{Offset: off, Start: p.StartOffset(), End: end}
+		}
+		msg, err := p.Read(off)
 		if err != nil {
 			return nil, err
 		}
+		if msg.Offset < end && visible(p, c, msg) {
+			return msg, nil
+		}
+		off = msg.Offset + 1
 	}
-
-	return msg, nil
 }
 
-func (s *Store) Append(msg []byte, topic string) error {
-	p, ok := s.topicToPartition[topic]
-	var err error
-	if !ok { // partition may have not been loaded or closed
-		p, err = storage.NewPartition(topic, s.config.Partition)
+// nextBatch is like next for a batch of messages, also returning the offset following the last one read.
+func (s *Store) nextBatch(p storage.Log, c model.Consumer, off uint64, maxMessages int, maxBytes int) ([]*model.Msg, uint64, error) {
+	end := readEnd(p, c)
+	for {
+		if off >= end {
+			return nil, 0, &storage.OffsetOutOfRangeError{Offset: off, Start: p.StartOffset(), End: end}
+		}
+		batch, err := p.ReadRange(off, maxMessages, maxBytes)
 		if err != nil {
-			return err
+			return nil, 0, err
+		}
+		var msgs []*model.Msg
+		for _, msg := range batch {
+			if msg.Offset >= end {
+				off = end
+				break
+			}
+			if visible(p, c, msg) {
+				msgs = append(msgs, msg)
+			}
+			off = msg.Offset + 1
+		}
+		if len(msgs) > 0 {
+			return msgs, off, nil
 		}
-		s.topicToPartition[topic] = p
 	}
+}
 
-	_, err = p.Append(msg)
-	return err
+// readEnd returns the offset the consumer reads up to: the last stable offset for read-committed consumers.
+func readEnd(p storage.Log, c model.Consumer) uint64 {
+	if c.ReadCommitted {
+		return p.LastStableOffset()
+	}
+	return math.MaxUint64 // bounded by the log
 }
 
-func (s *Store) AddConsumer(c model.Consumer) error {
-	p, ok := s.topicToPartition[c.Topic]
-	var err error
-	if !ok {
-		p, err = storage.NewPartition(c.Topic, s.config.Partition)
-		if err != nil {
-			return err
+// visible reports whether the consumer may see msg. Transaction markers are hidden from every consumer.
+func visible(p storage.Log, c model.Consumer, msg *model.Msg) bool {
+	if msg.Control != model.ControlNone {
+		return false
+	}
+	return !c.ReadCommitted || !msg.Transactional || !p.Aborted(msg)
+}
+
+// readPosition returns the consumer's partition and read offset, moving the consumer to the partition's
+// start offset when the messages it was positioned at were removed by retention.
+func (s *Store) readPosition(c model.Consumer) (storage.Log, uint64, error) {
+	p, err := s.partition(c.Topic, c.Partition) // loaded first so a legacy topic's consumers are migrated
+	if err != nil {
+		return nil, 0, err
+	}
+
+	readOff, err := s.cMgr.Read(c.ID, consumerTopic(c))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if startOff := p.StartOffset(); readOff < startOff {
+		if err = s.cMgr.Seek(c.ID, consumerTopic(c), startOff); err != nil {
+			return nil, 0, err
 		}
-		s.topicToPartition[c.Topic] = p
+		readOff = startOff
+	}
+	return p, readOff, nil
+}
+
+// Append writes msg to the partition of topic chosen by the store's partitioner, which hashes the message key,
+// and returns the partition and offset it was written at. Appends fail with an error wrapping
+// storage.ErrQuotaExceeded once the topic or the store reached its quota, see cfg.Quota.
+func (s *Store) Append(msg model.Msg, topic string) (partition int, offset uint64, err error) {
+	return s.AppendWith(msg, topic, s.partitioner)
+}
+
+// AppendWith is like Append but lets partitioner choose the partition.
+func (s *Store) AppendWith(msg model.Msg, topic string, partitioner Partitioner) (partition int, offset uint64, err error) {
+	partitions, err := s.partitions(topic)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	partition, err = partitioner.Partition(msg, len(partitions))
+	if err != nil {
+		return 0, 0, err
+	}
+	p, err := s.appendPartition(topic, partition)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	offset, err = p.Append(msg)
+	if err != nil {
+		return 0, 0, err
 	}
-	c.ReadOffset = p.LatestCommitedOff() + 1 // future read offset
+	return partition, offset, nil
+}
+
+// AddConsumer subscribes the consumer to its partition of the topic, from the next message appended.
+func (s *Store) AddConsumer(c model.Consumer) error {
+	p, err := s.partition(c.Topic, c.Partition)
+	if err != nil {
+		return err
+	}
+	c.ReadOffset = p.HighWatermark() // future read offset
+	c.Topic = consumerTopic(c)
 	return s.cMgr.Add(c)
 }
 
 func (s *Store) RemoveConsumer(c model.Consumer) error {
-	return s.cMgr.Remove(c.ID, c.Topic)
+	if _, err := s.partition(c.Topic, c.Partition); err != nil {
+		return err
+	}
+	return s.cMgr.Remove(c.ID, consumerTopic(c))
+}
+
+// consumerTopic returns the name the consumer manager tracks the consumer's read offset under, which is
+// kept per partition.
+func consumerTopic(c model.Consumer) string {
+	return storage.PartitionName(c.Topic, c.Partition)
 }
 
 func (s *Store) Close() error {
+	defer s.engine.Close()
+	if s.txns.stop != nil {
+		close(s.txns.stop)
+		s.txns.background.Wait()
+	}
 	if err := s.cMgr.Close(); err != nil {
 		return err
 	}
+	return s.closeLogs()
+}
 
-	for _, p := range s.topicToPartition {
-		if err := p.Close(); err != nil {
-			return err
+// closeLogs closes the loaded partitions and the transaction log.
+func (s *Store) closeLogs() error {
+	s.pLock.Lock()
+	defer s.pLock.Unlock()
+	for _, partitions := range s.topics {
+		for _, p := range partitions {
+			if err := p.Close(); err != nil {
+				return err
+			}
 		}
 	}
+	if s.txns.log != nil {
+		return s.txns.log.Close()
+	}
 	return nil
 }
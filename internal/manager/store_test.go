@@ -1,14 +1,16 @@
 package manager
 
 import (
+	"context"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"github.com/vandathron/bcaster/internal/cfg"
 	"github.com/vandathron/bcaster/internal/model"
-	"io"
+	"github.com/vandathron/bcaster/internal/storage"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestNewStore(t *testing.T) {
@@ -28,7 +30,7 @@ func TestNewStore(t *testing.T) {
 	store, err := NewStore(config)
 	require.NoError(t, err)
 	require.NotNil(t, store)
-	require.Equal(t, 0, len(store.topicToPartition))
+	require.Equal(t, 0, len(store.topics))
 	require.NotNil(t, store.cMgr)
 }
 
@@ -49,7 +51,7 @@ func TestStore_Append_Read(t *testing.T) {
 	require.NoError(t, err)
 
 	topic := "topic_A"
-	err = store.Append([]byte("Hello world"), topic)
+	_, _, err = store.Append(model.Msg{Value: []byte("Hello world")}, topic)
 	require.NoError(t, err)
 	require.NoError(t, store.Close())
 
@@ -61,20 +63,22 @@ func TestStore_Append_Read(t *testing.T) {
 
 	require.NoError(t, store.AddConsumer(c))
 	msgByte, err := store.Read(c)
-	require.Equal(t, io.EOF, err)
+	require.ErrorIs(t, err, storage.ErrOffsetOutOfRange)
 	require.Nil(t, msgByte)
 
-	require.NoError(t, store.Append([]byte("Second hello world"), topic))
+	_, _, err = store.Append(model.Msg{Value: []byte("Second hello world")}, topic)
+	require.NoError(t, err)
 	require.NoError(t, store.AddConsumer(c)) // expects not to duplicate consumer in storage
 	msgByte, err = store.Read(c)
 	require.NoError(t, err)
-	require.Equal(t, []byte("Second hello world"), msgByte)
-	require.NoError(t, store.Append([]byte("Third hello world"), topic))
+	require.Equal(t, []byte("Second hello world"), msgByte.Value)
+	_, _, err = store.Append(model.Msg{Value: []byte("Third hello world")}, topic)
+	require.NoError(t, err)
 	require.NoError(t, store.RemoveConsumer(c))
 
 	msgByte, err = store.Read(c) // attempts to consumer messages for a consumer already removed from topic
 	require.NotNil(t, err)
-	require.Equal(t, fmt.Sprintf("consumer not found for topic: %s", topic), err.Error())
+	require.Equal(t, fmt.Sprintf("consumer not found for topic: %s", storage.PartitionName(topic, 0)), err.Error())
 	require.Nil(t, msgByte)
 	require.NoError(t, store.Close())
 }
@@ -94,3 +98,619 @@ func getCfg(cdir, pDir string) cfg.Store {
 		},
 	}
 }
+
+func TestStore_ReadAfterRetention(t *testing.T) {
+	dir, err := os.MkdirTemp("", "store_test")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	require.NoError(t, err)
+	cDir := filepath.Join(dir, "consumers")
+	pDir := filepath.Join(dir, "partitions")
+	require.NoError(t, os.MkdirAll(cDir, 0750))
+	require.NoError(t, os.MkdirAll(pDir, 0750))
+	config := getCfg(cDir, pDir)
+	config.Partition.MaxMsgSizeByte = 1024
+	config.Partition.RetentionByte = 1024
+
+	store, err := NewStore(config)
+	require.NoError(t, err)
+
+	topic := "topic_A"
+	c := model.Consumer{ID: "new_consumer", Topic: topic, AutoCommit: true}
+	require.NoError(t, store.AddConsumer(c))
+	for i := 0; i < 100; i++ {
+		_, _, err = store.Append(model.Msg{Value: []byte(fmt.Sprintf("hello world %d", i))}, topic)
+		require.NoError(t, err)
+	}
+
+	deleted, err := store.topics[topic][0].(*storage.Partition).EnforceRetention()
+	require.NoError(t, err)
+	require.Greater(t, deleted, 0)
+	startOff := store.topics[topic][0].StartOffset()
+
+	// consumer positioned before the start offset resumes from the earliest message left
+	msg, err := store.Read(c)
+	require.NoError(t, err)
+	require.Equal(t, startOff, msg.Offset)
+	require.Equal(t, []byte(fmt.Sprintf("hello world %d", startOff)), msg.Value)
+	msg, err = store.Read(c)
+	require.NoError(t, err)
+	require.Equal(t, startOff+1, msg.Offset)
+	require.NoError(t, store.Close())
+}
+
+func TestStore_ReadBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "store_test")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	require.NoError(t, err)
+	cDir := filepath.Join(dir, "consumers")
+	pDir := filepath.Join(dir, "partitions")
+	require.NoError(t, os.MkdirAll(cDir, 0750))
+	require.NoError(t, os.MkdirAll(pDir, 0750))
+	config := getCfg(cDir, pDir)
+
+	store, err := NewStore(config)
+	require.NoError(t, err)
+
+	topic := "topic_A"
+	c := model.Consumer{ID: "new_consumer", Topic: topic, AutoCommit: true}
+	require.NoError(t, store.AddConsumer(c))
+	for i := 0; i < 25; i++ {
+		_, _, err = store.Append(model.Msg{Value: []byte(fmt.Sprintf("hello world %d", i))}, topic)
+		require.NoError(t, err)
+	}
+
+	for batch := 0; batch < 3; batch++ {
+		msgs, err := store.ReadBatch(c, 10, 1024*1024)
+		require.NoError(t, err)
+		require.Equal(t, min(10, 25-batch*10), len(msgs))
+		for i, msg := range msgs {
+			require.Equal(t, []byte(fmt.Sprintf("hello world %d", batch*10+i)), msg.Value)
+		}
+	}
+	_, err = store.ReadBatch(c, 10, 1024*1024)
+	require.ErrorIs(t, err, storage.ErrOffsetOutOfRange)
+	require.NoError(t, store.Close())
+
+	store, err = NewStore(config) // committed position survives a restart
+	require.NoError(t, err)
+	_, _, err = store.Append(model.Msg{Value: []byte("hello world 25")}, topic)
+	require.NoError(t, err)
+	msgs, err := store.ReadBatch(c, 10, 1024*1024)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, uint64(25), msgs[0].Offset)
+	require.NoError(t, store.Close())
+}
+
+func TestStore_ReadWait(t *testing.T) {
+	dir, err := os.MkdirTemp("", "store_test")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	require.NoError(t, err)
+	cDir := filepath.Join(dir, "consumers")
+	pDir := filepath.Join(dir, "partitions")
+	require.NoError(t, os.MkdirAll(cDir, 0750))
+	require.NoError(t, os.MkdirAll(pDir, 0750))
+
+	store, err := NewStore(getCfg(cDir, pDir))
+	require.NoError(t, err)
+	defer store.Close()
+
+	topic := "topic_A"
+	c := model.Consumer{ID: "new_consumer", Topic: topic, AutoCommit: true}
+	require.NoError(t, store.AddConsumer(c))
+
+	received := make(chan *model.Msg)
+	go func() {
+		msg, err := store.ReadWait(context.Background(), c)
+		require.NoError(t, err)
+		received <- msg
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_, _, err = store.Append(model.Msg{Value: []byte("hello world")}, topic)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), (<-received).Value)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = store.ReadWait(ctx, c)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestStore_Partitions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "store_test")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	require.NoError(t, err)
+	cDir := filepath.Join(dir, "consumers")
+	pDir := filepath.Join(dir, "partitions")
+	require.NoError(t, os.MkdirAll(cDir, 0750))
+	require.NoError(t, os.MkdirAll(pDir, 0750))
+	config := getCfg(cDir, pDir)
+	config.Partitions = 2
+
+	store, err := NewStore(config)
+	require.NoError(t, err)
+
+	topic := "topic_A"
+	require.NoError(t, store.CreateTopic(topic, 3))
+	require.Error(t, store.CreateTopic(topic, 3))
+	n, err := store.Partitions(topic)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	n, err = store.Partitions("topic_B") // created on first use with the default count
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	consumers := make([]model.Consumer, 3)
+	for i := range consumers {
+		consumers[i] = model.Consumer{ID: "new_consumer", Topic: topic, Partition: i, AutoCommit: true}
+		require.NoError(t, store.AddConsumer(consumers[i]))
+	}
+	require.ErrorIs(t, store.AddConsumer(model.Consumer{ID: "new_consumer", Topic: topic, Partition: 3}), storage.ErrPartitionNotFound)
+
+	// messages with the same key land on the same partition
+	keyPartition, _, err := store.Append(model.Msg{Key: []byte("key"), Value: []byte("hello world 0")}, topic)
+	require.NoError(t, err)
+	for i := 1; i < 5; i++ {
+		partition, offset, err := store.Append(model.Msg{Key: []byte("key"), Value: []byte(fmt.Sprintf("hello world %d", i))}, topic)
+		require.NoError(t, err)
+		require.Equal(t, keyPartition, partition)
+		require.Equal(t, uint64(i), offset)
+	}
+
+	partition, offset, err := store.AppendWith(model.Msg{Value: []byte("explicit")}, topic, ExplicitPartitioner((keyPartition+1)%3))
+	require.NoError(t, err)
+	require.Equal(t, (keyPartition+1)%3, partition)
+	require.Equal(t, uint64(0), offset)
+	_, _, err = store.AppendWith(model.Msg{Value: []byte("explicit")}, topic, ExplicitPartitioner(3))
+	require.ErrorIs(t, err, storage.ErrPartitionNotFound)
+	require.NoError(t, store.Close())
+
+	// partitions are read independently and the partition count survives a restart
+	store, err = NewStore(config)
+	require.NoError(t, err)
+	defer store.Close()
+	n, err = store.Partitions(topic)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	msgs, err := store.ReadBatch(consumers[keyPartition], 10, 1024*1024)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(msgs))
+	msg, err := store.Read(consumers[(keyPartition+1)%3])
+	require.NoError(t, err)
+	require.Equal(t, []byte("explicit"), msg.Value)
+	_, err = store.Read(consumers[(keyPartition+2)%3])
+	require.ErrorIs(t, err, storage.ErrOffsetOutOfRange)
+}
+
+func TestStore_MigrateSinglePartitionTopic(t *testing.T) {
+	dir, err := os.MkdirTemp("", "store_test")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	require.NoError(t, err)
+	cDir := filepath.Join(dir, "consumers")
+	pDir := filepath.Join(dir, "partitions")
+	require.NoError(t, os.MkdirAll(cDir, 0750))
+	require.NoError(t, os.MkdirAll(pDir, 0750))
+	config := getCfg(cDir, pDir)
+	config.Partitions = 4
+
+	// a topic stored the way it was before topics had partitions
+	topic := "topic_A"
+	p, err := storage.NewPartition(topic, config.Partition)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = p.Append(model.Msg{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, p.Close())
+	cMgr, err := NewConsumerMgr(config.Consumer)
+	require.NoError(t, err)
+	require.NoError(t, cMgr.Add(model.Consumer{ID: "new_consumer", Topic: topic, ReadOffset: 1}))
+	require.NoError(t, cMgr.Close())
+	// a legacy topic whose name is that of partition 0 of another topic
+	p, err = storage.NewPartition(storage.PartitionName("topic_B", 0), config.Partition)
+	require.NoError(t, err)
+	_, err = p.Append(model.Msg{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+
+	store, err := NewStore(config)
+	require.NoError(t, err)
+	defer store.Close()
+
+	c := model.Consumer{ID: "new_consumer", Topic: topic, AutoCommit: true}
+	msg, err := store.Read(c)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world 1"), msg.Value)
+	n, err := store.Partitions(topic)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	_, err = os.Stat(filepath.Join(pDir, "part_"+topic))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(filepath.Join(pDir, "topic_"+topic+".migrating"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// the legacy topic is not taken for a migrated one, and is itself migrated
+	_, _, err = store.Append(model.Msg{Value: []byte("hello world")}, "topic_B")
+	require.ErrorIs(t, err, storage.ErrTopicConflict)
+	legacy, err := store.partition("topic_B-0", 0)
+	require.NoError(t, err)
+	msg, err = legacy.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), msg.Value)
+}
+
+func TestStore_DirLock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "store_test")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	require.NoError(t, err)
+	cDir := filepath.Join(dir, "consumers")
+	pDir := filepath.Join(dir, "partitions")
+	require.NoError(t, os.MkdirAll(cDir, 0750))
+	config := getCfg(cDir, pDir)
+
+	store, err := NewStore(config)
+	require.NoError(t, err)
+	_, err = NewStore(config)
+	require.ErrorIs(t, err, storage.ErrDirLocked)
+	_, err = NewStore(getCfg(filepath.Join(dir, "other_consumers"), pDir)) // partitions alone are locked too
+	require.ErrorIs(t, err, storage.ErrDirLocked)
+
+	require.NoError(t, store.Close())
+	store, err = NewStore(config)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	shared := getCfg(dir, dir) // consumers and partitions in the same directory
+	store, err = NewStore(shared)
+	require.NoError(t, err)
+	_, err = NewStore(shared)
+	require.ErrorIs(t, err, storage.ErrDirLocked)
+	require.NoError(t, store.Close())
+}
+
+func TestStore_MemoryEngine(t *testing.T) {
+	engine := storage.NewMemoryEngine()
+	store, err := NewStoreWithEngine(cfg.Store{Partitions: 2}, engine)
+	require.NoError(t, err)
+
+	topic := "topic_A"
+	c := model.Consumer{ID: "new_consumer", Topic: topic, Partition: 1, AutoCommit: true}
+	require.NoError(t, store.AddConsumer(c))
+	for i := 0; i < 3; i++ {
+		partition, offset, err := store.AppendWith(model.Msg{Value: []byte(fmt.Sprintf("hello world %d", i))}, topic, ExplicitPartitioner(1))
+		require.NoError(t, err)
+		require.Equal(t, 1, partition)
+		require.Equal(t, uint64(i), offset)
+	}
+	msgs, err := store.ReadBatch(c, 1, 1024*1024)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world 0"), msgs[0].Value)
+	require.NoError(t, store.Close())
+
+	// data and consumer positions survive reopening a store on the same engine
+	store, err = NewStoreWithEngine(cfg.Store{}, engine)
+	require.NoError(t, err)
+	defer store.Close()
+	n, err := store.Partitions(topic)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	msgs, err = store.ReadBatch(c, 10, 1024*1024)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, []byte("hello world 1"), msgs[0].Value)
+	_, err = store.Read(c)
+	require.ErrorIs(t, err, storage.ErrOffsetOutOfRange)
+}
+
+func TestStore_IdempotentProducer(t *testing.T) {
+	dir, err := os.MkdirTemp("", "store_test")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	require.NoError(t, err)
+	cDir := filepath.Join(dir, "consumers")
+	pDir := filepath.Join(dir, "partitions")
+	require.NoError(t, os.MkdirAll(cDir, 0750))
+	config := getCfg(cDir, pDir)
+	config.Partitions = 2
+
+	store, err := NewStore(config)
+	require.NoError(t, err)
+	producer, err := store.InitProducer()
+	require.NoError(t, err)
+	require.Equal(t, model.Producer{ID: 1}, producer)
+
+	topic := "topic_A"
+	msgs := []model.Msg{{Value: []byte("hello world 0")}, {Value: []byte("hello world 1")}}
+	for i := 0; i < 2; i++ { // the retry is dropped
+		first, last, err := store.AppendIdempotent(producer, topic, 1, msgs)
+		require.NoError(t, err)
+		require.Equal(t, []uint64{0, 1}, []uint64{first, last})
+	}
+	_, _, err = store.AppendIdempotent(producer, topic, 2, msgs)
+	require.ErrorIs(t, err, storage.ErrPartitionNotFound)
+	require.NoError(t, store.Close())
+
+	// producer ids are never handed out twice
+	store, err = NewStore(config)
+	require.NoError(t, err)
+	defer store.Close()
+	producer, err = store.InitProducer()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), producer.ID)
+}
+
+func TestStore_ReinitProducer(t *testing.T) {
+	dir, err := os.MkdirTemp("", "store_test")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	require.NoError(t, err)
+	cDir := filepath.Join(dir, "consumers")
+	pDir := filepath.Join(dir, "partitions")
+	require.NoError(t, os.MkdirAll(cDir, 0750))
+	config := getCfg(cDir, pDir)
+
+	store, err := NewStore(config)
+	require.NoError(t, err)
+	first, err := store.InitProducer()
+	require.NoError(t, err)
+	require.NoError(t, store.BeginTransaction(first))
+	_, _, err = store.AppendTransactional(first, "orders", 0, []model.Msg{{Value: []byte("order 0")}})
+	require.NoError(t, err)
+
+	// a new instance fences the old one and aborts its open transaction
+	second, err := store.ReinitProducer(first.ID)
+	require.NoError(t, err)
+	require.Equal(t, model.Producer{ID: first.ID, Epoch: 1}, second)
+	p, err := store.partition("orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, p.HighWatermark(), p.LastStableOffset())
+	require.ErrorIs(t, store.CommitTransaction(first), storage.ErrProducerFenced)
+	require.ErrorIs(t, store.BeginTransaction(first), storage.ErrProducerFenced)
+	first.Sequence = 1
+	_, _, err = store.AppendIdempotent(first, "orders", 0, []model.Msg{{Value: []byte("order 1")}})
+	require.ErrorIs(t, err, storage.ErrProducerFenced)
+	_, _, err = store.AppendIdempotent(second, "orders", 0, []model.Msg{{Value: []byte("order 1")}})
+	require.NoError(t, err)
+
+	_, err = store.ReinitProducer(first.ID + 1)
+	require.ErrorIs(t, err, storage.ErrProducerNotFound)
+	require.NoError(t, store.Close())
+
+	// epochs survive a restart
+	store, err = NewStore(config)
+	require.NoError(t, err)
+	defer store.Close()
+	_, _, err = store.AppendIdempotent(first, "orders", 0, []model.Msg{{Value: []byte("order 2")}})
+	require.ErrorIs(t, err, storage.ErrProducerFenced)
+	third, err := store.ReinitProducer(first.ID)
+	require.NoError(t, err)
+	require.Equal(t, uint16(2), third.Epoch)
+
+	// appends racing a new instance land before its epoch is issued or are fenced
+	type result struct {
+		last uint64
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		var res result
+		for producer := third; ; producer.Sequence++ {
+			var offset uint64
+			if offset, _, res.err = store.AppendIdempotent(producer, "orders", 0, []model.Msg{{Value: []byte("order")}}); res.err != nil {
+				done <- res
+				return
+			}
+			res.last = offset
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_, err = store.ReinitProducer(first.ID)
+	require.NoError(t, err)
+	p, err = store.partition("orders", 0)
+	require.NoError(t, err)
+	hwm := p.HighWatermark()
+	res := <-done
+	require.ErrorIs(t, res.err, storage.ErrProducerFenced)
+	require.Less(t, res.last, hwm)
+	require.Equal(t, hwm, p.HighWatermark())
+}
+
+func TestStore_Transactions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "store_test")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	require.NoError(t, err)
+	cDir := filepath.Join(dir, "consumers")
+	pDir := filepath.Join(dir, "partitions")
+	require.NoError(t, os.MkdirAll(cDir, 0750))
+	config := getCfg(cDir, pDir)
+
+	store, err := NewStore(config)
+	require.NoError(t, err)
+	producer, err := store.InitProducer()
+	require.NoError(t, err)
+	committed := model.Consumer{ID: "committed", Topic: "orders", AutoCommit: true, ReadCommitted: true}
+	uncommitted := model.Consumer{ID: "uncommitted", Topic: "orders", AutoCommit: true}
+	payments := model.Consumer{ID: "committed", Topic: "payments", AutoCommit: true, ReadCommitted: true}
+	for _, c := range []model.Consumer{committed, uncommitted, payments} {
+		require.NoError(t, store.AddConsumer(c))
+	}
+
+	_, _, err = store.AppendTransactional(producer, "orders", 0, []model.Msg{{Value: []byte("order 0")}})
+	require.ErrorIs(t, err, storage.ErrInvalidTxnState)
+	require.NoError(t, store.BeginTransaction(producer))
+	require.ErrorIs(t, store.BeginTransaction(producer), storage.ErrInvalidTxnState)
+	_, _, err = store.AppendTransactional(producer, "orders", 0, []model.Msg{{Value: []byte("order 0")}})
+	require.NoError(t, err)
+	_, _, err = store.AppendTransactional(producer, "payments", 0, []model.Msg{{Value: []byte("payment 0")}})
+	require.NoError(t, err)
+
+	_, err = store.Read(committed)
+	require.ErrorIs(t, err, storage.ErrOffsetOutOfRange)
+	msg, err := store.Read(uncommitted)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order 0"), msg.Value)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	read := make(chan *model.Msg)
+	go func() {
+		msg, err := store.ReadWait(ctx, committed)
+		require.NoError(t, err)
+		read <- msg
+	}()
+	require.NoError(t, store.CommitTransaction(producer))
+	require.Equal(t, []byte("order 0"), (<-read).Value)
+	msgs, err := store.ReadBatch(payments, 10, 1024*1024)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, []byte("payment 0"), msgs[0].Value)
+
+	// aborted messages are skipped by read-committed consumers, markers by every consumer
+	producer.Sequence = 1
+	require.NoError(t, store.BeginTransaction(producer))
+	_, _, err = store.AppendTransactional(producer, "orders", 0, []model.Msg{{Value: []byte("order 1")}})
+	require.NoError(t, err)
+	require.NoError(t, store.AbortTransaction(producer))
+	require.ErrorIs(t, store.CommitTransaction(producer), storage.ErrInvalidTxnState)
+	_, _, err = store.Append(model.Msg{Value: []byte("order 2")}, "orders")
+	require.NoError(t, err)
+	msgs, err = store.ReadBatch(committed, 10, 1024*1024)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, []byte("order 2"), msgs[0].Value)
+	msgs, err = store.ReadBatch(uncommitted, 10, 1024*1024)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, []byte("order 1"), msgs[0].Value)
+
+	// a transaction left open when the store closes is aborted when it is opened again
+	producer.Sequence = 2
+	require.NoError(t, store.BeginTransaction(producer))
+	_, _, err = store.AppendTransactional(producer, "orders", 0, []model.Msg{{Value: []byte("order 3")}})
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	store, err = NewStore(config)
+	require.NoError(t, err)
+	defer store.Close()
+	_, _, err = store.Append(model.Msg{Value: []byte("order 4")}, "orders")
+	require.NoError(t, err)
+	msg, err = store.Read(committed)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order 4"), msg.Value)
+	require.ErrorIs(t, store.CommitTransaction(producer), storage.ErrInvalidTxnState)
+}
+
+func TestStore_TransactionTimeout(t *testing.T) {
+	store, err := NewStoreWithEngine(cfg.Store{TransactionTimeout: 50 * time.Millisecond}, storage.NewMemoryEngine())
+	require.NoError(t, err)
+	defer store.Close()
+	producer, err := store.InitProducer()
+	require.NoError(t, err)
+	c := model.Consumer{ID: "committed", Topic: "orders", AutoCommit: true, ReadCommitted: true}
+	require.NoError(t, store.AddConsumer(c))
+
+	require.NoError(t, store.BeginTransaction(producer))
+	_, _, err = store.AppendTransactional(producer, "orders", 0, []model.Msg{{Value: []byte("order 0")}})
+	require.NoError(t, err)
+	p, err := store.partition("orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), p.LastStableOffset())
+
+	// the abandoned transaction is aborted, so it no longer holds back read-committed consumers
+	require.Eventually(t, func() bool { return p.LastStableOffset() == p.HighWatermark() }, 5*time.Second, 10*time.Millisecond)
+	require.ErrorIs(t, store.CommitTransaction(producer), storage.ErrInvalidTxnState)
+	_, _, err = store.Append(model.Msg{Value: []byte("order 1")}, "orders")
+	require.NoError(t, err)
+	msg, err := store.Read(c)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order 1"), msg.Value)
+}
+
+func TestStore_Quotas(t *testing.T) {
+	dir, err := os.MkdirTemp("", "store_test")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	require.NoError(t, err)
+	cDir := filepath.Join(dir, "consumers")
+	pDir := filepath.Join(dir, "partitions")
+	require.NoError(t, os.MkdirAll(cDir, 0750))
+	config := getCfg(cDir, pDir)
+	config.Quota = cfg.Quota{TopicBytes: 200, Topics: map[string]uint64{"logs": 0}, GlobalBytes: 1000}
+
+	store, err := NewStore(config)
+	require.NoError(t, err)
+	msg := model.Msg{Value: make([]byte, 100)}
+
+	// the append reaching the topic quota is accepted, the next is rejected
+	for i := 0; i < 2; i++ {
+		_, _, err = store.Append(msg, "orders")
+		require.NoError(t, err)
+	}
+	_, _, err = store.Append(msg, "orders")
+	var quotaErr *storage.QuotaExceededError
+	require.ErrorAs(t, err, &quotaErr)
+	require.Equal(t, "orders", quotaErr.Topic)
+	require.Equal(t, uint64(200), quotaErr.Limit)
+	producer, err := store.InitProducer()
+	require.NoError(t, err)
+	_, _, err = store.AppendIdempotent(producer, "orders", 0, []model.Msg{msg})
+	require.ErrorIs(t, err, storage.ErrQuotaExceeded)
+
+	// an unlimited topic is only bounded by the global quota
+	for err = nil; err == nil; {
+		_, _, err = store.Append(msg, "logs")
+	}
+	require.ErrorAs(t, err, &quotaErr)
+	require.Equal(t, "", quotaErr.Topic)
+	require.NoError(t, store.Close())
+
+	// topics on disk count towards the global quota as soon as the store opens
+	store, err = NewStore(config)
+	require.NoError(t, err)
+	defer store.Close()
+	_, _, err = store.Append(msg, "events")
+	require.ErrorIs(t, err, storage.ErrQuotaExceeded)
+
+	global, topics, err := store.Quotas()
+	require.NoError(t, err)
+	require.True(t, global.Exceeded)
+	require.GreaterOrEqual(t, global.Used, uint64(1000))
+	require.Equal(t, uint64(1000), global.Limit)
+	require.Equal(t, 3, len(topics))
+	require.Equal(t, QuotaUsage{Topic: "events", Limit: 200}, topics[0])
+	require.Equal(t, "logs", topics[1].Topic)
+	require.Equal(t, uint64(0), topics[1].Limit)
+	require.False(t, topics[1].Exceeded)
+	require.Equal(t, "orders", topics[2].Topic)
+	require.True(t, topics[2].Exceeded)
+	require.Equal(t, global.Used, topics[0].Used+topics[1].Used+topics[2].Used)
+}
@@ -0,0 +1,114 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"github.com/vandathron/bcaster/internal/storage"
+)
+
+// CreateTopic creates topic with the given number of partitions. Topics that are appended to or subscribed
+// to before being created get the configured default number of partitions.
+func (s *Store) CreateTopic(topic string, partitions int) error {
+	if partitions <= 0 {
+		return fmt.Errorf("topic should have at least one partition: %d", partitions)
+	}
+
+	s.pLock.Lock()
+	defer s.pLock.Unlock()
+	if _, err := s.engine.ReadTopicMeta(topic); !errors.Is(err, storage.ErrTopicNotFound) {
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("topic already exists: %s", topic)
+	}
+	_, migrated, err := s.initTopic(topic, partitions)
+	if err != nil {
+		return err
+	}
+	if migrated {
+		return fmt.Errorf("topic already exists: %s", topic)
+	}
+	_, err = s.loadTopic(topic)
+	return err
+}
+
+// Partitions returns the number of partitions of topic.
+func (s *Store) Partitions(topic string) (int, error) {
+	partitions, err := s.partitions(topic)
+	if err != nil {
+		return 0, err
+	}
+	return len(partitions), nil
+}
+
+// partition returns partition n of topic.
+func (s *Store) partition(topic string, n int) (storage.Log, error) {
+	partitions, err := s.partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n >= len(partitions) {
+		return nil, partitionNotFound(topic, n)
+	}
+	return partitions[n], nil
+}
+
+// partitions returns the partitions of topic, loading them if they have not been loaded.
+func (s *Store) partitions(topic string) ([]storage.Log, error) {
+	s.pLock.Lock()
+	defer s.pLock.Unlock()
+	if partitions, ok := s.topics[topic]; ok {
+		return partitions, nil
+	}
+	return s.loadTopic(topic)
+}
+
+// loadTopic opens the partitions of topic, creating the topic with the default number of partitions when it
+// does not exist. s.pLock must be held.
+func (s *Store) loadTopic(topic string) ([]storage.Log, error) {
+	meta, err := s.engine.ReadTopicMeta(topic)
+	if errors.Is(err, storage.ErrTopicNotFound) {
+		meta, _, err = s.initTopic(topic, max(s.config.Partitions, 1))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := make([]storage.Log, 0, meta.Partitions)
+	for n := 0; n < meta.Partitions; n++ {
+		p, err := s.engine.OpenLog(storage.PartitionName(topic, n))
+		if err != nil {
+			for _, p := range partitions {
+				_ = p.Close()
+			}
+			return nil, err
+		}
+		partitions = append(partitions, p)
+	}
+	s.topics[topic] = partitions
+	return partitions, nil
+}
+
+// initTopic writes the metadata of a topic that has none. A topic stored by earlier versions in a single log
+// becomes partition 0 of a one partition topic, its consumers included, which is reported as migrated. Every
+// step is repeated until the metadata is written, so a crash part way through is picked up on the next load.
+func (s *Store) initTopic(topic string, partitions int) (meta storage.TopicMeta, migrated bool, err error) {
+	meta = storage.TopicMeta{Partitions: partitions}
+	if migrated, err = s.engine.MigrateLegacyLog(topic); err != nil {
+		return storage.TopicMeta{}, false, err
+	}
+	if migrated {
+		if err = s.cMgr.renameTopic(topic, storage.PartitionName(topic, 0)); err != nil {
+			return storage.TopicMeta{}, false, err
+		}
+		meta.Partitions = 1
+	}
+	if err = s.engine.WriteTopicMeta(topic, meta); err != nil {
+		return storage.TopicMeta{}, false, err
+	}
+	return meta, migrated, nil
+}
+
+func partitionNotFound(topic string, n int) error {
+	return fmt.Errorf("%w: %d of topic %s", storage.ErrPartitionNotFound, n, topic)
+}
@@ -0,0 +1,311 @@
+package manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/vandathron/bcaster/internal/model"
+	"github.com/vandathron/bcaster/internal/storage"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// txnLogName is the log transaction state changes are recorded in. Topic partitions are named
+// "<topic>-<n>", so it cannot clash with one.
+const txnLogName = "__transactions"
+
+const (
+	txnRecordVersionV1 = byte(1)
+	txnRecordHeader    = 1 + 2 + 1 + 4 // version, epoch, status, partition count
+)
+
+type txnStatus byte
+
+const (
+	txnOngoing txnStatus = iota + 1
+	txnPrepareCommit
+	txnPrepareAbort
+	txnComplete
+)
+
+type topicPartition struct {
+	topic     string
+	partition int
+}
+
+type txnState struct {
+	epoch      uint16
+	status     txnStatus
+	partitions []topicPartition // appended to so far, in the order they were added
+	started    time.Time        // zero for a transaction recovered from the log, which is finished on recovery
+}
+
+// transactions coordinates producers' transactions. Every state change is appended to a log before it takes
+// effect, so transactions interrupted by a crash are finished when the store is opened again.
+type transactions struct {
+	lock       sync.Mutex // serializes transactional appends and state changes
+	log        storage.Log
+	states     map[uint64]*txnState // unfinished transactions by producer id
+	stop       chan struct{}        // closed to stop aborting timed out transactions
+	background sync.WaitGroup
+}
+
+// BeginTransaction opens a transaction for producer. Messages it appends with AppendTransactional are hidden
+// from read-committed consumers until CommitTransaction, and for good after AbortTransaction. A transaction
+// left open by an older epoch of the producer is aborted first.
+func (s *Store) BeginTransaction(producer model.Producer) error {
+	if producer.ID == 0 {
+		return errors.New("producer id should be positive")
+	}
+	s.txns.lock.Lock()
+	defer s.txns.lock.Unlock()
+	if err := s.checkEpoch(producer); err != nil { // under the lock so ReinitProducer cannot interleave
+		return err
+	}
+	if t, ok := s.txns.states[producer.ID]; ok {
+		if producer.Epoch < t.epoch {
+			return fmt.Errorf("%w: producer %d epoch %d, current epoch %d", storage.ErrProducerFenced, producer.ID,
+				producer.Epoch, t.epoch)
+		}
+		if producer.Epoch == t.epoch {
+			return fmt.Errorf("%w: producer %d already has an open transaction", storage.ErrInvalidTxnState, producer.ID)
+		}
+		if err := s.endTransaction(producer.ID, t, model.ControlAbort); err != nil {
+			return err
+		}
+	}
+	s.txns.states[producer.ID] = &txnState{epoch: producer.Epoch, status: txnOngoing, started: time.Now()}
+	return nil
+}
+
+// AppendTransactional is like AppendIdempotent for messages of producer's open transaction.
+func (s *Store) AppendTransactional(producer model.Producer, topic string, partition int, msgs []model.Msg) (first, last uint64, err error) {
+	p, err := s.appendPartition(topic, partition)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	s.txns.lock.Lock()
+	defer s.txns.lock.Unlock()
+	t, err := s.openTransaction(producer)
+	if err != nil {
+		return 0, 0, err
+	}
+	if tp := (topicPartition{topic: topic, partition: partition}); !slices.Contains(t.partitions, tp) {
+		t.partitions = append(t.partitions, tp)
+		if err = s.logTransaction(producer.ID, t); err != nil { // logged first so recovery aborts the partition too
+			t.partitions = t.partitions[:len(t.partitions)-1]
+			return 0, 0, err
+		}
+	}
+
+	batch := make([]model.Msg, len(msgs))
+	for i, msg := range msgs {
+		msg.Transactional = true
+		batch[i] = msg
+	}
+	return p.AppendIdempotent(producer, batch)
+}
+
+// CommitTransaction makes the messages of producer's open transaction visible to read-committed consumers.
+func (s *Store) CommitTransaction(producer model.Producer) error {
+	return s.finishTransaction(producer, model.ControlCommit)
+}
+
+// AbortTransaction discards the messages of producer's open transaction.
+func (s *Store) AbortTransaction(producer model.Producer) error {
+	return s.finishTransaction(producer, model.ControlAbort)
+}
+
+func (s *Store) finishTransaction(producer model.Producer, control model.Control) error {
+	s.txns.lock.Lock()
+	defer s.txns.lock.Unlock()
+	t, err := s.openTransaction(producer)
+	if err != nil {
+		return err
+	}
+	return s.endTransaction(producer.ID, t, control)
+}
+
+// openTransaction returns producer's open transaction. s.txns.lock must be held.
+func (s *Store) openTransaction(producer model.Producer) (*txnState, error) {
+	if err := s.checkEpoch(producer); err != nil {
+		return nil, err
+	}
+	t, ok := s.txns.states[producer.ID]
+	if !ok {
+		return nil, fmt.Errorf("%w: producer %d has no open transaction", storage.ErrInvalidTxnState, producer.ID)
+	}
+	if producer.Epoch != t.epoch {
+		return nil, fmt.Errorf("%w: producer %d epoch %d, transaction epoch %d", storage.ErrProducerFenced,
+			producer.ID, producer.Epoch, t.epoch)
+	}
+	return t, nil
+}
+
+// endTransaction logs the decision to commit or abort t, writes the matching marker to each of its partitions
+// and logs that it completed. s.txns.lock must be held.
+func (s *Store) endTransaction(id uint64, t *txnState, control model.Control) error {
+	status := txnPrepareCommit
+	if control == model.ControlAbort {
+		status = txnPrepareAbort
+	}
+	if t.status != status {
+		t.status = status
+		if err := s.logTransaction(id, t); err != nil {
+			return err
+		}
+	}
+
+	producer := model.Producer{ID: id, Epoch: t.epoch}
+	for _, tp := range t.partitions {
+		p, err := s.partition(tp.topic, tp.partition)
+		if err != nil {
+			return err
+		}
+		if err = p.WriteMarker(producer, control); err != nil {
+			return err
+		}
+	}
+
+	t.status = txnComplete
+	if err := s.logTransaction(id, t); err != nil {
+		return err
+	}
+	delete(s.txns.states, id)
+	return nil
+}
+
+// runTxnTimeouts aborts the transactions left open for longer than the store's transaction timeout, checking
+// twice per timeout so none stays open for more than one and a half times as long.
+func (s *Store) runTxnTimeouts() {
+	defer s.txns.background.Done()
+	ticker := time.NewTicker(s.config.TransactionTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.txns.stop:
+			return
+		case now := <-ticker.C:
+			_ = s.abortTimedOutTransactions(now) // retried on the next tick
+		}
+	}
+}
+
+// abortTimedOutTransactions aborts the ongoing transactions begun more than the transaction timeout before now.
+func (s *Store) abortTimedOutTransactions(now time.Time) error {
+	s.txns.lock.Lock()
+	defer s.txns.lock.Unlock()
+	for id, t := range s.txns.states {
+		if t.status == txnOngoing && now.Sub(t.started) > s.config.TransactionTimeout {
+			if err := s.endTransaction(id, t, model.ControlAbort); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recoverTransactions opens the transaction log and finishes the transactions it records as unfinished:
+// those being committed are committed and the others aborted. The log is emptied afterwards, as every
+// transaction it records is complete.
+func (s *Store) recoverTransactions() error {
+	log, err := s.engine.OpenLog(txnLogName)
+	if err != nil {
+		return err
+	}
+	s.txns.log = log
+	s.txns.states = make(map[uint64]*txnState)
+
+	for off := log.StartOffset(); off < log.HighWatermark(); {
+		msgs, err := log.ReadRange(off, 1024, 1024*1024)
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			id, t, err := decodeTxnRecord(msg)
+			if err != nil {
+				return err
+			}
+			if t.status == txnComplete {
+				delete(s.txns.states, id)
+			} else {
+				s.txns.states[id] = t
+			}
+			off = msg.Offset + 1
+		}
+	}
+
+	s.txns.lock.Lock()
+	defer s.txns.lock.Unlock()
+	for id, t := range s.txns.states {
+		control := model.ControlAbort
+		if t.status == txnPrepareCommit {
+			control = model.ControlCommit
+		}
+		if err = s.endTransaction(id, t, control); err != nil {
+			return err
+		}
+	}
+	return log.TruncateTo(log.StartOffset())
+}
+
+// logTransaction appends the state of producer id's transaction to the transaction log.
+func (s *Store) logTransaction(id uint64, t *txnState) error {
+	msg, err := encodeTxnRecord(id, t)
+	if err != nil {
+		return err
+	}
+	_, err = s.txns.log.Append(msg)
+	return err
+}
+
+// A transaction record is keyed by the producer id (8). Its value layout (v1), all integers big endian:
+//
+//	version (1) | epoch (2) | status (1) | partition count (4) | [topic len (2) | topic | partition (4)]...
+func encodeTxnRecord(id uint64, t *txnState) (model.Msg, error) {
+	value := []byte{txnRecordVersionV1}
+	value = binary.BigEndian.AppendUint16(value, t.epoch)
+	value = append(value, byte(t.status))
+	value = binary.BigEndian.AppendUint32(value, uint32(len(t.partitions)))
+	for _, tp := range t.partitions {
+		if len(tp.topic) > math.MaxUint16 {
+			return model.Msg{}, fmt.Errorf("topic of size %v exceeds max size of %v", len(tp.topic), math.MaxUint16)
+		}
+		value = binary.BigEndian.AppendUint16(value, uint16(len(tp.topic)))
+		value = append(value, tp.topic...)
+		value = binary.BigEndian.AppendUint32(value, uint32(tp.partition))
+	}
+	return model.Msg{Key: binary.BigEndian.AppendUint64(nil, id), Value: value}, nil
+}
+
+func decodeTxnRecord(msg *model.Msg) (uint64, *txnState, error) {
+	invalid := fmt.Errorf("invalid transaction record at offset %d", msg.Offset)
+	b := msg.Value
+	if len(msg.Key) != 8 || len(b) < txnRecordHeader || b[0] != txnRecordVersionV1 {
+		return 0, nil, invalid
+	}
+	t := &txnState{epoch: binary.BigEndian.Uint16(b[1:]), status: txnStatus(b[3])}
+	count := binary.BigEndian.Uint32(b[4:])
+	b = b[txnRecordHeader:]
+	for i := uint32(0); i < count; i++ {
+		if len(b) < 2 {
+			return 0, nil, invalid
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+n+4 {
+			return 0, nil, invalid
+		}
+		t.partitions = append(t.partitions, topicPartition{
+			topic:     string(b[2 : 2+n]),
+			partition: int(binary.BigEndian.Uint32(b[2+n:])),
+		})
+		b = b[2+n+4:]
+	}
+	if len(b) != 0 || t.status < txnOngoing || t.status > txnComplete {
+		return 0, nil, invalid
+	}
+	return binary.BigEndian.Uint64(msg.Key), t, nil
+}
@@ -3,7 +3,10 @@ package model
 type Consumer struct {
 	ID         string
 	Topic      string
+	Partition  int
 	ReadOffset uint64
 	Off        uint32
 	AutoCommit bool
+	// ReadCommitted hides messages of open and aborted transactions from the consumer.
+	ReadCommitted bool
 }
@@ -0,0 +1,37 @@
+package model
+
+import "time"
+
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+type Msg struct {
+	Offset    uint64 // assigned by the partition on append
+	Key       []byte
+	Value     []byte
+	Timestamp time.Time
+	Headers   []Header
+	Producer  Producer // zero unless written by an idempotent producer
+	// Transactional is set on messages a producer appended inside a transaction.
+	Transactional bool
+	Control       Control // set on the marker ending a producer's transaction in a partition
+}
+
+// Control tells a transaction marker from a message and whether it commits or aborts the transaction.
+type Control byte
+
+const (
+	ControlNone Control = iota
+	ControlCommit
+	ControlAbort
+)
+
+// Producer identifies an idempotent producer and the sequence number of one of its messages. Sequence numbers
+// start at zero and increase by one with every message a producer epoch writes to a partition.
+type Producer struct {
+	ID       uint64 // assigned by the store, zero for messages without a producer
+	Epoch    uint16
+	Sequence int32
+}
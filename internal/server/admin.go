@@ -0,0 +1,33 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/vandathron/bcaster/internal/manager"
+	"net/http"
+)
+
+// QuotaState is the body of GET /quotas.
+type QuotaState struct {
+	Global manager.QuotaUsage   `json:"global"`
+	Topics []manager.QuotaUsage `json:"topics"`
+}
+
+// NewAdminHandler serves the store's admin API as JSON:
+//
+//	GET /quotas  disk usage of the store and of each topic against their quotas, see QuotaState
+func NewAdminHandler(store *manager.Store) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /quotas", func(w http.ResponseWriter, _ *http.Request) {
+		global, topics, err := store.Quotas()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if topics == nil {
+			topics = []manager.QuotaUsage{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(QuotaState{Global: global, Topics: topics})
+	})
+	return mux
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"github.com/vandathron/bcaster/internal/cfg"
+	"github.com/vandathron/bcaster/internal/manager"
+	"github.com/vandathron/bcaster/internal/model"
+	"github.com/vandathron/bcaster/internal/storage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminHandler_Quotas(t *testing.T) {
+	store, err := manager.NewStoreWithEngine(cfg.Store{Quota: cfg.Quota{TopicBytes: 10}}, storage.NewMemoryEngine())
+	require.NoError(t, err)
+	defer store.Close()
+	_, _, err = store.Append(model.Msg{Value: []byte("hello world")}, "orders")
+	require.NoError(t, err)
+
+	handler := NewAdminHandler(store)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/quotas", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var state QuotaState
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+	require.Equal(t, uint64(0), state.Global.Limit)
+	require.Equal(t, 1, len(state.Topics))
+	require.Equal(t, "orders", state.Topics[0].Topic)
+	require.Equal(t, uint64(10), state.Topics[0].Limit)
+	require.True(t, state.Topics[0].Exceeded)
+	require.Equal(t, state.Global.Used, state.Topics[0].Used)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/quotas", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
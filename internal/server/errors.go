@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/vandathron/bcaster/internal/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ToStatus converts an error returned by the store into a gRPC status error carrying a code clients can act
+// on. Errors without a dedicated code are reported as Internal.
+func ToStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(code(err), err.Error())
+}
+
+func code(err error) codes.Code {
+	switch {
+	case errors.Is(err, storage.ErrOffsetOutOfRange):
+		return codes.OutOfRange
+	case errors.Is(err, storage.ErrTopicNotFound), errors.Is(err, storage.ErrPartitionNotFound),
+		errors.Is(err, storage.ErrConsumerNotFound), errors.Is(err, storage.ErrTimestampNotFound),
+		errors.Is(err, storage.ErrProducerNotFound):
+		return codes.NotFound
+	case errors.Is(err, storage.ErrMessageTooLarge), errors.Is(err, storage.ErrEmptyBatch):
+		return codes.InvalidArgument
+	case errors.Is(err, storage.ErrCorruptRecord):
+		return codes.DataLoss
+	case errors.Is(err, storage.ErrOutOfOrderSequence), errors.Is(err, storage.ErrProducerFenced),
+		errors.Is(err, storage.ErrInvalidTxnState), errors.Is(err, storage.ErrTopicConflict):
+		return codes.FailedPrecondition
+	case errors.Is(err, storage.ErrDuplicateSequence):
+		return codes.AlreadyExists
+	case errors.Is(err, storage.ErrConsumerFileFull), errors.Is(err, storage.ErrQuotaExceeded):
+		return codes.ResourceExhausted
+	case errors.Is(err, storage.ErrPartitionClosed):
+		return codes.Unavailable
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	default:
+		return codes.Internal
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"github.com/vandathron/bcaster/internal/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestToStatus(t *testing.T) {
+	require.NoError(t, ToStatus(nil))
+
+	tests := []struct {
+		err  error
+		code codes.Code
+	}{
+		{&storage.OffsetOutOfRangeError{Offset: 10, Start: 0, End: 10}, codes.OutOfRange},
+		{fmt.Errorf("%w: orders", storage.ErrTopicNotFound), codes.NotFound},
+		{fmt.Errorf("%w: 3 of topic orders", storage.ErrPartitionNotFound), codes.NotFound},
+		{fmt.Errorf("%w for topic: orders", storage.ErrConsumerNotFound), codes.NotFound},
+		{storage.ErrTimestampNotFound, codes.NotFound},
+		{fmt.Errorf("%w: 7", storage.ErrProducerNotFound), codes.NotFound},
+		{storage.ErrMessageTooLarge, codes.InvalidArgument},
+		{storage.ErrEmptyBatch, codes.InvalidArgument},
+		{&storage.CorruptRecordError{Pos: 20, Reason: "checksum mismatch"}, codes.DataLoss},
+		{fmt.Errorf("%w: producer 1 expected 3, got 5", storage.ErrOutOfOrderSequence), codes.FailedPrecondition},
+		{storage.ErrProducerFenced, codes.FailedPrecondition},
+		{fmt.Errorf("%w: part_orders-0", storage.ErrTopicConflict), codes.FailedPrecondition},
+		{storage.ErrDuplicateSequence, codes.AlreadyExists},
+		{storage.ErrConsumerFileFull, codes.ResourceExhausted},
+		{&storage.QuotaExceededError{Topic: "orders", Used: 2048, Limit: 1024}, codes.ResourceExhausted},
+		{storage.ErrPartitionClosed, codes.Unavailable},
+		{context.Canceled, codes.Canceled},
+		{context.DeadlineExceeded, codes.DeadlineExceeded},
+		{errors.New("disk failure"), codes.Internal},
+		{status.Error(codes.PermissionDenied, "denied"), codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		err := ToStatus(tt.err)
+		require.Equal(t, tt.code, status.Code(err), tt.err.Error())
+		require.Contains(t, err.Error(), tt.err.Error())
+	}
+}
@@ -0,0 +1,31 @@
+package storage
+
+import "time"
+
+// runCleaner periodically enforces retention and, for compacted partitions, compacts closed segments.
+func (p *Partition) runCleaner() {
+	defer p.background.Done()
+
+	var retentionTick, compactionTick <-chan time.Time // nil channels never fire
+	if p.cfg.RetentionCheckInterval > 0 {
+		ticker := time.NewTicker(p.cfg.RetentionCheckInterval)
+		defer ticker.Stop()
+		retentionTick = ticker.C
+	}
+	if p.cfg.Compact && p.cfg.CompactionInterval > 0 {
+		ticker := time.NewTicker(p.cfg.CompactionInterval)
+		defer ticker.Stop()
+		compactionTick = ticker.C
+	}
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-retentionTick:
+			_, _ = p.EnforceRetention() // retried on the next tick
+		case <-compactionTick:
+			_, _ = p.Compact()
+		}
+	}
+}
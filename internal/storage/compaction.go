@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"errors"
+	"github.com/vandathron/bcaster/internal/model"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	compactingExt = ".compacting" // directory a segment is rewritten into
+	swapExt       = ".swap"       // a fully written rewrite, renamed from compactingExt as the commit point
+)
+
+// Compact rewrites closed segments so they only hold the latest message for each key. Messages without a key
+// are kept. A tombstone, a message with an empty value, hides every earlier message for its key and is itself
+// removed once older than the partition's tombstone retention. Messages of aborted transactions are removed,
+// and segments holding messages of open transactions are left for a later compaction.
+func (p *Partition) Compact() (removed int, err error) {
+	p.cleanLock.Lock()
+	defer p.cleanLock.Unlock()
+
+	stable := p.LastStableOffset()
+	p.producersLock.RLock()
+	aborted := &producerStates{aborted: maps.Clone(p.producers.aborted)}
+	p.producersLock.RUnlock()
+
+	p.segLock.RLock()
+	var closed []*Segment // closed segments are immutable, so they can be read without holding the lock
+	for _, s := range p.segments {
+		if s != p.writableSegment && s.nextOffset <= stable {
+			closed = append(closed, s)
+		}
+	}
+	p.segLock.RUnlock()
+
+	latest := make(map[string]uint64) // key to the offset of its latest message
+	for _, s := range closed {
+		err = s.forEach(func(msg *model.Msg) error {
+			if len(msg.Key) > 0 && !aborted.isAborted(msg) {
+				latest[string(msg.Key)] = msg.Offset
+			}
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	tombstoneDeadline := time.Now().Add(-p.cfg.TombstoneRetention)
+	keep := func(msg *model.Msg) bool {
+		if aborted.isAborted(msg) {
+			return false
+		}
+		if len(msg.Key) == 0 {
+			return true
+		}
+		if latest[string(msg.Key)] != msg.Offset {
+			return false
+		}
+		return len(msg.Value) > 0 || msg.Timestamp.After(tombstoneDeadline)
+	}
+
+	for _, s := range closed {
+		n, err := p.compactSegment(s, keep)
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+	if len(closed) > 0 && p.StartOffset() == closed[0].cfg.StartOffset { // offloaded segments were not compacted
+		p.pruneAborted(closed[len(closed)-1].nextOffset)
+	}
+	return removed, nil
+}
+
+// compactSegment copies the messages of s that should be kept into a new segment and swaps it in place of s.
+func (p *Partition) compactSegment(s *Segment, keep func(msg *model.Msg) bool) (removed int, err error) {
+	dir := p.Name()
+	tmpDir := formatName(s.cfg.StartOffset, dir, compactingExt)
+	if err = os.RemoveAll(tmpDir); err != nil {
+		return 0, err
+	}
+	if err = os.MkdirAll(tmpDir, 0750); err != nil {
+		return 0, err
+	}
+
+	// the rewrite keeps the creation time and key of s
+	if err = writeSegmentMeta(formatName(s.cfg.StartOffset, tmpDir, ".meta"), s.meta); err != nil {
+		return 0, err
+	}
+	cleaned, err := newSegment(tmpDir, s.cfg, p.keys)
+	if err != nil {
+		return 0, err
+	}
+	err = s.forEach(func(msg *model.Msg) error {
+		if !keep(msg) {
+			removed++
+			return nil
+		}
+		_, err := cleaned.append(msg.Offset, *msg)
+		return err
+	})
+	if closeErr := cleaned.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || removed == 0 {
+		return 0, errors.Join(err, os.RemoveAll(tmpDir))
+	}
+
+	for _, ext := range []string{".message", ".index", ".timeindex"} {
+		if err = syncPath(formatName(s.cfg.StartOffset, tmpDir, ext)); err != nil {
+			return 0, err
+		}
+	}
+	swapDir := formatName(s.cfg.StartOffset, dir, swapExt)
+	if err = os.Rename(tmpDir, swapDir); err != nil {
+		return 0, err
+	}
+	if err = syncPath(dir); err != nil {
+		return 0, err
+	}
+
+	p.segLock.Lock()
+	defer p.segLock.Unlock()
+	if err = s.Close(); err != nil {
+		return 0, err
+	}
+	if err = completeSwap(dir, swapDir); err != nil {
+		return 0, err
+	}
+	reopened, err := newSegment(dir, s.cfg, p.keys)
+	if err != nil {
+		return 0, err
+	}
+	for i := range p.segments {
+		if p.segments[i] == s {
+			p.segments[i] = reopened
+		}
+	}
+	p.recordCache.purge(s.cfg.StartOffset, s.nextOffset)
+	return removed, nil
+}
+
+// recoverCompaction finishes swaps that were committed before a crash and discards unfinished rewrites.
+func recoverCompaction(dir string) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		name := filepath.Join(dir, file.Name())
+		switch {
+		case strings.HasSuffix(file.Name(), swapExt):
+			err = completeSwap(dir, name)
+		case strings.HasSuffix(file.Name(), compactingExt):
+			err = os.RemoveAll(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// completeSwap moves every file in swapDir over its counterpart in dir and removes swapDir.
+func completeSwap(dir, swapDir string) error {
+	files, err := os.ReadDir(swapDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = os.Rename(filepath.Join(swapDir, file.Name()), filepath.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+	if err = os.Remove(swapDir); err != nil {
+		return err
+	}
+	return syncPath(dir)
+}
+
+// syncPath flushes a file or directory to stable storage.
+func syncPath(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"github.com/vandathron/bcaster/internal/model"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPartition_Compact(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topic := "customer_state"
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 1024
+	config.Compact = true
+	config.TombstoneRetention = time.Hour
+
+	partition, err := NewPartition(topic, config)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		msg := model.Msg{Key: []byte(fmt.Sprintf("customer_%d", i%5)), Value: []byte(fmt.Sprintf("state_%d", i))}
+		switch i {
+		case 10: // keyless messages are never compacted
+			msg.Key = nil
+		case 20: // expired tombstone
+			msg.Key, msg.Value, msg.Timestamp = []byte("deleted_old"), nil, time.Now().Add(-2*time.Hour)
+		case 21: // recent tombstone
+			msg.Key, msg.Value = []byte("deleted_new"), nil
+		}
+		_, err := partition.Append(msg)
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(partition.segments), 3)
+	closedEnd := partition.writableSegment.cfg.StartOffset
+	segmentSizes := make([]uint64, len(partition.segments))
+	for i, s := range partition.segments {
+		segmentSizes[i] = s.Size()
+	}
+
+	removed, err := partition.Compact()
+	require.NoError(t, err)
+	require.Greater(t, removed, 0)
+	for i, s := range partition.segments[:len(partition.segments)-1] {
+		require.Less(t, s.Size(), segmentSizes[i])
+	}
+	require.Equal(t, segmentSizes[len(segmentSizes)-1], partition.writableSegment.Size())
+
+	requireCompacted := func() {
+		var offsets []uint64
+		for off := uint64(0); off < 100; {
+			msg, err := partition.Read(off)
+			require.NoError(t, err)
+			require.GreaterOrEqual(t, msg.Offset, off)
+			offsets = append(offsets, msg.Offset)
+			off = msg.Offset + 1
+		}
+
+		expected := []uint64{10, 21} // keyless message and recent tombstone
+		for key := uint64(0); key < 5; key++ {
+			latest := key
+			for latest+5 < closedEnd {
+				latest += 5
+			}
+			expected = append(expected, latest)
+		}
+		for off := closedEnd; off < 100; off++ { // writable segment is untouched
+			expected = append(expected, off)
+		}
+		require.ElementsMatch(t, expected, offsets)
+	}
+	requireCompacted()
+
+	removed, err = partition.Compact() // nothing left to remove
+	require.NoError(t, err)
+	require.Equal(t, 0, removed)
+	require.NoError(t, partition.Close())
+
+	// reopen
+	partition, err = NewPartition(topic, config)
+	require.NoError(t, err)
+	for _, s := range partition.segments {
+		require.False(t, s.Recovery().Repaired())
+	}
+	requireCompacted()
+	off, err := partition.Append(model.Msg{Key: []byte("customer_0"), Value: []byte("state_100")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), off)
+	require.NoError(t, partition.Close())
+}
+
+func TestPartition_CompactRecovery(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topic := "customer_state"
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 1024
+	config.Compact = true
+
+	partition, err := NewPartition(topic, config)
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		_, err := partition.Append(model.Msg{Key: []byte("customer"), Value: []byte(fmt.Sprintf("state_%d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(partition.segments), 1)
+	require.NoError(t, partition.Close())
+
+	// rewrite of segment 0 committed but not swapped in before a crash
+	swapDir := formatName(0, partition.Name(), swapExt)
+	require.NoError(t, os.MkdirAll(swapDir, 0750))
+	cleaned, err := NewSegment(swapDir, config.Segment)
+	require.NoError(t, err)
+	require.NoError(t, cleaned.Close())
+	// unfinished rewrite of another segment
+	compactingDir := formatName(1, partition.Name(), compactingExt)
+	require.NoError(t, os.MkdirAll(compactingDir, 0750))
+	require.NoError(t, os.WriteFile(filepath.Join(compactingDir, "1.message"), []byte("partial"), 0666))
+
+	partition, err = NewPartition(topic, config)
+	require.NoError(t, err)
+	_, err = os.Stat(swapDir)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(compactingDir)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.Equal(t, uint64(0), partition.segments[0].Size()) // empty rewrite swapped in
+
+	msg, err := partition.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, partition.segments[1].cfg.StartOffset, msg.Offset)
+	require.NoError(t, partition.Close())
+}
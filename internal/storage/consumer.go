@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"github.com/tysonmote/gommap"
-	"io"
 	"os"
 	"sync"
 )
@@ -15,6 +14,8 @@ var (
 	IdSize       = 35 // 35 bytes as ID size
 	TopicSize    = 35 // 35 bytes as topic
 	consumerSize = offSize + IdSize + TopicSize
+
+	encryptedSlotOverhead = keyIDWidth + 12 + 16 // key id, GCM nonce and tag
 )
 
 type Consumer struct {
@@ -25,10 +26,22 @@ type Consumer struct {
 	lock     sync.Mutex
 	nextOff  uint32
 	baseOff  uint32
+	keys     *keyring // nil unless slots are encrypted
+	slotSize int
 }
 
 func NewConsumer(filePath string, maxSize uint32, baseOff uint32) (*Consumer, error) {
-	c := &Consumer{maxSize: maxSize, baseOff: baseOff}
+	return NewEncryptedConsumer(filePath, maxSize, baseOff, nil)
+}
+
+// NewEncryptedConsumer opens a consumer file whose slots are encrypted, each with the key that was current
+// when it was last written. Encrypted slots are larger, so a file is either encrypted or not for its whole
+// life. A nil keys opens a plain file like NewConsumer.
+func NewEncryptedConsumer(filePath string, maxSize uint32, baseOff uint32, keys KeyProvider) (*Consumer, error) {
+	c := &Consumer{maxSize: maxSize, baseOff: baseOff, keys: newKeyring(keys), slotSize: consumerSize}
+	if c.keys != nil {
+		c.slotSize += encryptedSlotOverhead
+	}
 
 	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
@@ -45,9 +58,9 @@ func NewConsumer(filePath string, maxSize uint32, baseOff uint32) (*Consumer, er
 		return nil, fmt.Errorf("current file size %d exceeds max size %d", c.currSize, c.maxSize)
 	}
 
-	c.nextOff = c.currSize/uint32(consumerSize) + baseOff
+	c.nextOff = c.currSize/uint32(c.slotSize) + baseOff
 	if c.currSize == 0 { // truncate the empty file to allow for memory-mapping
-		if err := c.file.Truncate(int64(consumerSize)); err != nil {
+		if err := c.file.Truncate(int64(c.slotSize)); err != nil {
 			return nil, err
 		}
 	}
@@ -78,24 +91,25 @@ func (c *Consumer) Append(id []byte, topic []byte, readOff uint64) (off uint32,
 	}
 
 	if c.isMaxed() {
-		return 0, io.EOF
+		return 0, ErrConsumerFileFull
+	}
+
+	buf, err := c.encodeSlot(c.nextOff, id, topic, readOff)
+	if err != nil {
+		return 0, err
 	}
 
 	if err = c.makeSpaceForExtraConsumer(); err != nil {
 		return 0, err
 	}
 
-	buf := make([]byte, consumerSize)
-	copy(buf[:IdSize], id)
-	copy(buf[IdSize:IdSize+TopicSize], topic)
-	binary.BigEndian.PutUint64(buf[IdSize+TopicSize:], readOff)
-	copy(c.mmap[c.currSize:c.currSize+uint32(consumerSize)], buf)
+	copy(c.mmap[c.currSize:c.currSize+uint32(c.slotSize)], buf)
 
 	if err = c.mmap.Sync(gommap.MS_SYNC); err != nil {
 		return 0, err
 	}
 	off = c.nextOff
-	c.currSize += uint32(consumerSize)
+	c.currSize += uint32(c.slotSize)
 	c.nextOff++ // update next offset to write
 	return off, nil
 }
@@ -115,12 +129,12 @@ func (c *Consumer) WriteAt(off uint32, id []byte, topic []byte, readOff uint64)
 		return fmt.Errorf("invalid offset %v. Last written offset: %v", off, c.nextOff-1)
 	}
 
-	buf := make([]byte, consumerSize)
-	copy(buf[:IdSize], id)
-	copy(buf[IdSize:IdSize+TopicSize], topic)
-	binary.BigEndian.PutUint64(buf[IdSize+TopicSize:], readOff)
-	startPos := (off - c.baseOff) * uint32(consumerSize)
-	copy(c.mmap[startPos:startPos+uint32(consumerSize)], buf)
+	buf, err := c.encodeSlot(off, id, topic, readOff)
+	if err != nil {
+		return err
+	}
+	startPos := (off - c.baseOff) * uint32(c.slotSize)
+	copy(c.mmap[startPos:startPos+uint32(c.slotSize)], buf)
 
 	if err := c.mmap.Sync(gommap.MS_ASYNC); err != nil {
 		return err
@@ -131,23 +145,82 @@ func (c *Consumer) WriteAt(off uint32, id []byte, topic []byte, readOff uint64)
 
 func (c *Consumer) Read(off uint32, ignoreOff bool) (id []byte, topic []byte, readOff uint64, err error) {
 	if off >= c.nextOff {
-		return nil, nil, 0, io.EOF
+		return nil, nil, 0, fmt.Errorf("%w at offset %d", ErrConsumerNotFound, off)
 	}
 
-	startPos := (off - c.baseOff) * uint32(consumerSize)
-	consumer := c.mmap[startPos : startPos+uint32(consumerSize)]
+	startPos := (off - c.baseOff) * uint32(c.slotSize)
+	consumer, err := c.decodeSlot(off, c.mmap[startPos:startPos+uint32(c.slotSize)])
+	if err != nil {
+		return nil, nil, 0, err
+	}
 	id = bytes.Trim(consumer[:IdSize], "\x00")                    // trim padded zero-bytes
 	topic = bytes.Trim(consumer[IdSize:IdSize+TopicSize], "\x00") // trim padded zero-bytes
 	readOff = binary.BigEndian.Uint64(consumer[IdSize+TopicSize:])
 
 	// update nextOffset
 	if !ignoreOff {
-		binary.BigEndian.PutUint64(c.mmap[startPos+uint32(IdSize+TopicSize):], readOff+1)
+		if c.keys == nil {
+			binary.BigEndian.PutUint64(c.mmap[startPos+uint32(IdSize+TopicSize):], readOff+1)
+		} else {
+			buf, err := c.encodeSlot(off, id, topic, readOff+1)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			copy(c.mmap[startPos:startPos+uint32(c.slotSize)], buf)
+		}
 	}
 
 	return id, topic, readOff, nil
 }
 
+// encodeSlot lays out the slot at off, encrypting it with the current key when the file is encrypted:
+//
+//	key id (4) | nonce (12) | ciphertext | tag (16)
+//
+// The key id and off are authenticated so a slot cannot be moved to another offset.
+func (c *Consumer) encodeSlot(off uint32, id []byte, topic []byte, readOff uint64) ([]byte, error) {
+	buf := make([]byte, consumerSize)
+	copy(buf[:IdSize], id)
+	copy(buf[IdSize:IdSize+TopicSize], topic)
+	binary.BigEndian.PutUint64(buf[IdSize+TopicSize:], readOff)
+	if c.keys == nil {
+		return buf, nil
+	}
+
+	keyID, aead, err := c.keys.current()
+	if err != nil {
+		return nil, err
+	}
+	additional := slotAdditionalData(keyID, off)
+	sealed, err := encrypt(aead, buf, additional)
+	if err != nil {
+		return nil, err
+	}
+	return append(additional[:keyIDWidth], sealed...), nil
+}
+
+// decodeSlot returns the plain layout of the slot at off.
+func (c *Consumer) decodeSlot(off uint32, slot []byte) ([]byte, error) {
+	if c.keys == nil {
+		return slot, nil
+	}
+	keyID := binary.BigEndian.Uint32(slot)
+	aead, err := c.keys.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := decrypt(aead, slot[keyIDWidth:], slotAdditionalData(keyID, off))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting consumer at offset %d: %w", off, err)
+	}
+	return plain, nil
+}
+
+func slotAdditionalData(keyID uint32, off uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, keyID)
+	return binary.BigEndian.AppendUint32(b, off)
+}
+
 func (c *Consumer) Close() error {
 	if err := c.mmap.UnsafeUnmap(); err != nil {
 		return err
@@ -160,19 +233,23 @@ func (c *Consumer) Close() error {
 	return c.file.Close()
 }
 
+func (c *Consumer) BaseOff() uint32 {
+	return c.baseOff
+}
+
 func (c *Consumer) LatestCommitedOff() uint32 {
 	return c.nextOff - 1
 }
 
 func (c *Consumer) isMaxed() bool {
-	return c.currSize+uint32(consumerSize) > c.maxSize
+	return c.currSize+uint32(c.slotSize) > c.maxSize
 }
 
 func (c *Consumer) makeSpaceForExtraConsumer() error {
 	if c.isMaxed() {
-		return io.EOF
+		return ErrConsumerFileFull
 	}
-	err := os.Truncate(c.file.Name(), int64(c.currSize+uint32(consumerSize)))
+	err := os.Truncate(c.file.Name(), int64(c.currSize+uint32(c.slotSize)))
 	if err != nil {
 		return err
 	}
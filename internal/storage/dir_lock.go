@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const dirLockFile = ".lock"
+
+// DirLock is an exclusive advisory lock on a data directory, held until Unlock or until the process exits.
+type DirLock struct {
+	file *os.File
+}
+
+// LockDir locks dir, creating it if needed, so no other process or store can open it at the same time. An
+// error wrapping ErrDirLocked is returned when the lock is already held.
+func LockDir(dir string) (*DirLock, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, dirLockFile), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", ErrDirLocked, dir)
+		}
+		return nil, err
+	}
+	return &DirLock{file: f}, nil
+}
+
+// Unlock releases the lock. The lock file is left in place, removing it would race with a process locking it.
+func (l *DirLock) Unlock() error {
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		_ = l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
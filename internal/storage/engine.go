@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"github.com/vandathron/bcaster/internal/model"
+)
+
+// Log is an append-only sequence of messages addressed by offset, such as a Partition.
+type Log interface {
+	Append(msg model.Msg) (uint64, error)
+	// AppendIdempotent appends msgs numbered by producer from producer.Sequence onwards, skipping a retried
+	// batch that was already appended. See Partition.AppendIdempotent.
+	AppendIdempotent(producer model.Producer, msgs []model.Msg) (first, last uint64, err error)
+	// Read returns the message at offset, or the first one after it when offset was removed. An error wrapping
+	// ErrOffsetOutOfRange is returned when there is no such message.
+	Read(offset uint64) (*model.Msg, error)
+	ReadRange(from uint64, maxMessages int, maxBytes int) ([]*model.Msg, error)
+	TruncateTo(offset uint64) error
+	// WriteMarker ends producer's open transaction with a commit or abort marker. See Partition.WriteMarker.
+	WriteMarker(producer model.Producer, control model.Control) error
+	StartOffset() uint64
+	HighWatermark() uint64
+	// LastStableOffset returns the offset of the first message of the oldest open transaction, or the high
+	// watermark when no transaction is open.
+	LastStableOffset() uint64
+	// Aborted reports whether msg, read from the log, belongs to an aborted transaction.
+	Aborted(msg *model.Msg) bool
+	// Size returns the bytes of messages the log keeps on local storage.
+	Size() uint64
+	WaitForOffset(ctx context.Context, offset uint64) error
+	Close() error
+}
+
+// OffsetStore keeps consumers' read offsets in numbered slots starting at BaseOff, such as a Consumer.
+type OffsetStore interface {
+	// Append fills the next slot, returning ErrConsumerFileFull when the store has no slot left.
+	Append(id []byte, topic []byte, readOff uint64) (off uint32, err error)
+	WriteAt(off uint32, id []byte, topic []byte, readOff uint64) error
+	// Read returns the slot at off, moving its read offset forward unless ignoreOff is set. An error wrapping
+	// ErrConsumerNotFound is returned past the last slot.
+	Read(off uint32, ignoreOff bool) (id []byte, topic []byte, readOff uint64, err error)
+	BaseOff() uint32
+	LatestCommitedOff() uint32
+	Close() error
+}
+
+// OffsetStorage opens the offset stores consumers are kept in.
+type OffsetStorage interface {
+	// OpenOffsetStores returns the existing offset stores ordered by base offset.
+	OpenOffsetStores() ([]OffsetStore, error)
+	CreateOffsetStore(baseOff uint32) (OffsetStore, error)
+}
+
+// Engine opens the logs, offset stores and topic metadata a store keeps its data in.
+type Engine interface {
+	OffsetStorage
+	// OpenLog opens the log stored under name, creating an empty one if there is none.
+	OpenLog(name string) (Log, error)
+	// ReadTopicMeta returns an error wrapping ErrTopicNotFound for a topic without metadata.
+	ReadTopicMeta(topic string) (TopicMeta, error)
+	WriteTopicMeta(topic string, m TopicMeta) error
+	// Topics returns the names of the topics with metadata, sorted.
+	Topics() ([]string, error)
+	// MigrateLegacyLog moves the log of a topic stored before topics had partitions to its partition 0,
+	// reporting whether there was one. It is only called for topics without metadata and may be repeated. An
+	// error wrapping ErrTopicConflict is returned when partition 0 is already taken by another topic's log.
+	MigrateLegacyLog(topic string) (bool, error)
+	// NextProducerID returns a producer id that was never returned before, starting at 1.
+	NextProducerID() (uint64, error)
+	// ProducerEpoch returns the current epoch of producer id, 0 until BumpProducerEpoch is called for it.
+	ProducerEpoch(id uint64) (uint16, error)
+	// BumpProducerEpoch increments and returns the epoch of producer id, failing with an error wrapping
+	// ErrProducerNotFound for an id NextProducerID never returned.
+	BumpProducerEpoch(id uint64) (uint16, error)
+	Close() error
+}
+
+var (
+	_ Log         = (*Partition)(nil)
+	_ OffsetStore = (*Consumer)(nil)
+	_ Engine      = (*FileEngine)(nil)
+	_ Engine      = (*MemoryEngine)(nil)
+)
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrCorruptRecord      = errors.New("corrupt record")
+	ErrSegmentFull        = errors.New("segment is full")
+	ErrMessageTooLarge    = errors.New("message does not fit in an empty segment")
+	ErrEmptyBatch         = errors.New("batch has no messages")
+	ErrPartitionClosed    = errors.New("partition is closed")
+	ErrOffsetOutOfRange   = errors.New("offset out of range")
+	ErrTimestampNotFound  = errors.New("no message at or after timestamp")
+	ErrTopicNotFound      = errors.New("topic not found")
+	ErrPartitionNotFound  = errors.New("partition not found")
+	ErrConsumerNotFound   = errors.New("consumer not found")
+	ErrConsumerFileFull   = errors.New("consumer file is full")
+	ErrDirLocked          = errors.New("data directory is locked by another store")
+	ErrOutOfOrderSequence = errors.New("out of order sequence number")
+	ErrDuplicateSequence  = errors.New("duplicate sequence number")
+	ErrProducerFenced     = errors.New("producer fenced by a newer epoch")
+	ErrProducerNotFound   = errors.New("producer not found")
+	ErrInvalidTxnState    = errors.New("invalid transaction state")
+	ErrKeyNotFound        = errors.New("encryption key not found")
+	ErrQuotaExceeded      = errors.New("disk quota exceeded")
+	ErrTopicConflict      = errors.New("topic conflicts with the log of another topic")
+)
+
+// CorruptRecordError describes a record that failed validation when read back from a message file.
+type CorruptRecordError struct {
+	Pos    uint64
+	Reason string
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("%v at pos %d: %s", ErrCorruptRecord, e.Pos, e.Reason)
+}
+
+func (e *CorruptRecordError) Unwrap() error {
+	return ErrCorruptRecord
+}
+
+// OffsetOutOfRangeError reports a read of an offset outside [Start, End), the messages a partition holds.
+// Offset equals End for a reader that has caught up with the partition.
+type OffsetOutOfRangeError struct {
+	Offset uint64
+	Start  uint64
+	End    uint64
+}
+
+func (e *OffsetOutOfRangeError) Error() string {
+	return fmt.Sprintf("%v: %d not in [%d, %d)", ErrOffsetOutOfRange, e.Offset, e.Start, e.End)
+}
+
+func (e *OffsetOutOfRangeError) Unwrap() error {
+	return ErrOffsetOutOfRange
+}
+
+// QuotaExceededError reports an append rejected because Used bytes reached the Limit of Topic, or of the
+// whole store when Topic is empty.
+type QuotaExceededError struct {
+	Topic string
+	Used  uint64
+	Limit uint64
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.Topic == "" {
+		return fmt.Sprintf("%v: store uses %d of %d bytes", ErrQuotaExceeded, e.Used, e.Limit)
+	}
+	return fmt.Sprintf("%v: topic %s uses %d of %d bytes", ErrQuotaExceeded, e.Topic, e.Used, e.Limit)
+}
+
+func (e *QuotaExceededError) Unwrap() error {
+	return ErrQuotaExceeded
+}
@@ -0,0 +1,329 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/vandathron/bcaster/internal/cfg"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	producerIDFile       = "producer.id"
+	producerEpochsFile   = "producer.epochs"
+	producerEpochWidth   = producerIDWidth + epochWidth
+	consumerExt          = ".consumer"
+	encryptedConsumerExt = ".econsumer"
+)
+
+// FileEngine keeps partitions, consumers and topic metadata in the directories of a cfg.Store, which it
+// locks until closed.
+type FileEngine struct {
+	*ConsumerDir
+	cfg          cfg.Store
+	keys         KeyProvider
+	recordCache  *RecordCache // nil unless cfg.Store.RecordCacheBytes is set
+	remote       RemoteStore  // nil unless cfg.Store.Tiering.RemoteDir is set
+	dirLocks     []*DirLock
+	producerLock sync.Mutex        // serializes producer id and epoch allocation
+	epochs       map[uint64]uint16 // current producer epochs, guarded by producerLock. Loaded on first use
+}
+
+// NewFileEngine locks the directories in c, failing with an error wrapping ErrDirLocked when another engine
+// has them open.
+func NewFileEngine(c cfg.Store) (*FileEngine, error) {
+	return NewEncryptedFileEngine(c, nil)
+}
+
+// NewEncryptedFileEngine is like NewFileEngine but encrypts new segments and consumer files with the current
+// key of keys. Data written before encryption was enabled stays readable. A nil keys encrypts nothing.
+func NewEncryptedFileEngine(c cfg.Store, keys KeyProvider) (*FileEngine, error) {
+	e := &FileEngine{ConsumerDir: NewConsumerDir(c.Consumer), cfg: c, keys: keys}
+	e.ConsumerDir.keys = keys
+	if c.RecordCacheBytes > 0 {
+		e.recordCache = NewRecordCache(c.RecordCacheBytes)
+	}
+	if c.Tiering.RemoteDir != "" {
+		remote, err := NewDirRemoteStore(c.Tiering.RemoteDir)
+		if err != nil {
+			return nil, err
+		}
+		e.remote = remote
+	}
+	dirs := []string{c.Partition.Dir}
+	if filepath.Clean(c.Consumer.Dir) != filepath.Clean(c.Partition.Dir) {
+		dirs = append(dirs, c.Consumer.Dir)
+	}
+	for _, dir := range dirs {
+		l, err := LockDir(dir)
+		if err != nil {
+			_ = e.Close()
+			return nil, err
+		}
+		e.dirLocks = append(e.dirLocks, l)
+	}
+	return e, nil
+}
+
+func (e *FileEngine) OpenLog(name string) (Log, error) {
+	p, err := NewEncryptedPartition(name, e.cfg.Partition, e.keys)
+	if err != nil {
+		return nil, err
+	}
+	if e.recordCache != nil {
+		p.EnableRecordCache(e.recordCache)
+	}
+	if e.remote != nil {
+		if err = p.EnableTiering(e.remote, e.cfg.Tiering); err != nil {
+			_ = p.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// RecordCache returns the cache the engine's partitions share, nil when it is disabled.
+func (e *FileEngine) RecordCache() *RecordCache {
+	return e.recordCache
+}
+
+func (e *FileEngine) ReadTopicMeta(topic string) (TopicMeta, error) {
+	m, err := readTopicMeta(e.cfg.Partition.Dir, topic)
+	if errors.Is(err, os.ErrNotExist) {
+		return TopicMeta{}, fmt.Errorf("%w: %s", ErrTopicNotFound, topic)
+	}
+	return m, err
+}
+
+// WriteTopicMeta writes the metadata of topic, completing a migration of its legacy log.
+func (e *FileEngine) WriteTopicMeta(topic string, m TopicMeta) error {
+	if err := writeTopicMeta(e.cfg.Partition.Dir, topic, m); err != nil {
+		return err
+	}
+	if err := os.Remove(migrationMarkerPath(e.cfg.Partition.Dir, topic)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (e *FileEngine) Topics() ([]string, error) {
+	return readTopics(e.cfg.Partition.Dir)
+}
+
+// MigrateLegacyLog renames the part_<topic> directory to the one of partition 0. A marker file is written
+// before the rename and removed along with writing the topic's metadata, so a crash part way through is picked
+// up on the next call. Without the marker, an existing directory of partition 0 belongs to a legacy topic
+// named <topic>-0, whose log is not merged into topic.
+func (e *FileEngine) MigrateLegacyLog(topic string) (bool, error) {
+	dir := e.cfg.Partition.Dir
+	legacyDir := filepath.Join(dir, fmt.Sprintf("part_%s", topic))
+	migratedDir := filepath.Join(dir, fmt.Sprintf("part_%s", PartitionName(topic, 0)))
+	marker := migrationMarkerPath(dir, topic)
+	_, legacyErr := os.Stat(legacyDir)
+	if _, err := os.Stat(marker); err == nil {
+		if legacyErr == nil {
+			return true, os.Rename(legacyDir, migratedDir)
+		}
+		return true, nil
+	}
+	if _, err := os.Stat(migratedDir); err == nil {
+		return false, fmt.Errorf("%w: %s is not partition 0 of topic %s", ErrTopicConflict, migratedDir, topic)
+	}
+	if legacyErr != nil {
+		return false, nil
+	}
+	if err := writeFileAtomic(marker, nil); err != nil {
+		return false, err
+	}
+	return true, os.Rename(legacyDir, migratedDir)
+}
+
+// NextProducerID allocates producer ids from a counter persisted in the partition directory.
+func (e *FileEngine) NextProducerID() (uint64, error) {
+	e.producerLock.Lock()
+	defer e.producerLock.Unlock()
+	last, err := e.lastProducerID()
+	if err != nil {
+		return 0, err
+	}
+	if err = writeFileAtomic(filepath.Join(e.cfg.Partition.Dir, producerIDFile), binary.BigEndian.AppendUint64(nil, last+1)); err != nil {
+		return 0, err
+	}
+	return last + 1, nil
+}
+
+func (e *FileEngine) ProducerEpoch(id uint64) (uint16, error) {
+	e.producerLock.Lock()
+	defer e.producerLock.Unlock()
+	if err := e.loadEpochs(); err != nil {
+		return 0, err
+	}
+	return e.epochs[id], nil
+}
+
+// BumpProducerEpoch persists the epochs of every producer that was bumped in a single file, rewritten
+// atomically.
+func (e *FileEngine) BumpProducerEpoch(id uint64) (uint16, error) {
+	e.producerLock.Lock()
+	defer e.producerLock.Unlock()
+	last, err := e.lastProducerID()
+	if err != nil {
+		return 0, err
+	}
+	if id == 0 || id > last {
+		return 0, fmt.Errorf("%w: %d", ErrProducerNotFound, id)
+	}
+	if err = e.loadEpochs(); err != nil {
+		return 0, err
+	}
+	epoch := e.epochs[id]
+	if epoch == math.MaxUint16 {
+		return 0, fmt.Errorf("producer %d has no epoch left", id)
+	}
+
+	ids := make([]uint64, 0, len(e.epochs)+1)
+	for other := range e.epochs {
+		ids = append(ids, other)
+	}
+	if epoch == 0 {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	b := make([]byte, 0, len(ids)*producerEpochWidth)
+	for _, other := range ids {
+		next := e.epochs[other]
+		if other == id {
+			next = epoch + 1
+		}
+		b = binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint64(b, other), next)
+	}
+	if err = writeFileAtomic(filepath.Join(e.cfg.Partition.Dir, producerEpochsFile), b); err != nil {
+		return 0, err
+	}
+	e.epochs[id] = epoch + 1
+	return epoch + 1, nil
+}
+
+// lastProducerID returns the last producer id allocated, 0 when there is none. e.producerLock must be held.
+func (e *FileEngine) lastProducerID() (uint64, error) {
+	name := filepath.Join(e.cfg.Partition.Dir, producerIDFile)
+	b, err := os.ReadFile(name)
+	switch {
+	case err == nil && len(b) == recOffsetWidth:
+		return binary.BigEndian.Uint64(b), nil
+	case err == nil:
+		return 0, fmt.Errorf("invalid producer id file: %s", name)
+	case errors.Is(err, os.ErrNotExist):
+		return 0, nil
+	default:
+		return 0, err
+	}
+}
+
+// loadEpochs reads the producer epochs file unless it was read already. e.producerLock must be held.
+func (e *FileEngine) loadEpochs() error {
+	if e.epochs != nil {
+		return nil
+	}
+	name := filepath.Join(e.cfg.Partition.Dir, producerEpochsFile)
+	b, err := os.ReadFile(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(b)%producerEpochWidth != 0 {
+		return fmt.Errorf("invalid producer epochs file: %s", name)
+	}
+	epochs := make(map[uint64]uint16, len(b)/producerEpochWidth)
+	for ; len(b) > 0; b = b[producerEpochWidth:] {
+		epochs[binary.BigEndian.Uint64(b)] = binary.BigEndian.Uint16(b[producerIDWidth:])
+	}
+	e.epochs = epochs
+	return nil
+}
+
+// Close releases the directory locks. Logs and offset stores are closed by whoever opened them.
+func (e *FileEngine) Close() error {
+	var err error
+	for _, l := range e.dirLocks {
+		if unlockErr := l.Unlock(); unlockErr != nil && err == nil {
+			err = unlockErr
+		}
+	}
+	e.dirLocks = nil
+	return err
+}
+
+// ConsumerDir keeps offset stores as <base offset>.consumer files in a directory, or as
+// <base offset>.econsumer files when they are encrypted.
+type ConsumerDir struct {
+	cfg  cfg.Consumer
+	keys KeyProvider // encrypts new offset stores unless nil
+}
+
+func NewConsumerDir(c cfg.Consumer) *ConsumerDir {
+	if c.MaxSizeByte == 0 || c.MaxSizeByte < 1024*70 { // 70kb
+		c.MaxSizeByte = (1024 * 1024) / 0.5 // 0.5mb
+	}
+	return &ConsumerDir{cfg: c}
+}
+
+func (d *ConsumerDir) OpenOffsetStores() ([]OffsetStore, error) {
+	files, err := os.ReadDir(d.cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var baseOffsets []uint32
+	for _, file := range files {
+		if ext := path.Ext(file.Name()); file.IsDir() || (ext != consumerExt && ext != encryptedConsumerExt) {
+			continue
+		}
+		baseOff, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), path.Ext(file.Name())), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid consumer file name. should be an integer: %s", file.Name())
+		}
+		baseOffsets = append(baseOffsets, uint32(baseOff))
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+
+	var stores []OffsetStore
+	for _, baseOff := range baseOffsets {
+		s, err := d.CreateOffsetStore(baseOff)
+		if err != nil {
+			for _, s := range stores {
+				_ = s.Close()
+			}
+			return nil, err
+		}
+		stores = append(stores, s)
+	}
+	return stores, nil
+}
+
+// CreateOffsetStore opens the offset store starting at baseOff, creating its file if there is none. An
+// existing file is opened as it was written, encrypted or not.
+func (d *ConsumerDir) CreateOffsetStore(baseOff uint32) (OffsetStore, error) {
+	plain := filepath.Join(d.cfg.Dir, fmt.Sprintf("%v%s", baseOff, consumerExt))
+	encrypted := filepath.Join(d.cfg.Dir, fmt.Sprintf("%v%s", baseOff, encryptedConsumerExt))
+	if _, err := os.Stat(encrypted); err == nil {
+		if d.keys == nil {
+			return nil, fmt.Errorf("%w: consumer file %s is encrypted", ErrKeyNotFound, encrypted)
+		}
+		return NewEncryptedConsumer(encrypted, d.cfg.MaxSizeByte, baseOff, d.keys)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if _, err := os.Stat(plain); err == nil || d.keys == nil {
+		return NewConsumer(plain, d.cfg.MaxSizeByte, baseOff)
+	}
+	return NewEncryptedConsumer(encrypted, d.cfg.MaxSizeByte, baseOff, d.keys)
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	keyExt     = ".key"
+	keyIDWidth = 4
+	keySize    = 32 // AES-256
+)
+
+// KeyProvider supplies the AES keys data is encrypted with at rest. Every key has an id, stored along with
+// the data it encrypted, so data stays readable after the current key is rotated.
+type KeyProvider interface {
+	// CurrentKey returns the key new data is encrypted with and its id, which is never zero.
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key returns the key with the given id, failing with an error wrapping ErrKeyNotFound for an unknown id.
+	Key(id uint32) ([]byte, error)
+}
+
+// FileKeyProvider keeps keys as <id>.key files holding the raw key bytes. The key with the highest id is
+// the current one.
+type FileKeyProvider struct {
+	dir     string
+	lock    sync.Mutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// NewFileKeyProvider loads the keys in dir, generating the first one when there is none.
+func NewFileKeyProvider(dir string) (*FileKeyProvider, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	k := &FileKeyProvider{dir: dir}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	if k.current == 0 {
+		if _, err := k.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+func (k *FileKeyProvider) CurrentKey() (uint32, []byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.current, k.keys[k.current], nil
+}
+
+// Key returns the key with the given id, looking for keys added to the directory since they were loaded
+// when it is unknown.
+func (k *FileKeyProvider) Key(id uint32) ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if key, ok := k.keys[id]; ok {
+		return key, nil
+	}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	if key, ok := k.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrKeyNotFound, id)
+}
+
+// Rotate generates a new random key, which becomes the current one, and returns its id.
+func (k *FileKeyProvider) Rotate() (uint32, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return 0, err
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	id := k.current + 1
+	f, err := os.OpenFile(filepath.Join(k.dir, fmt.Sprintf("%d%s", id, keyExt)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = f.Write(key); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err = syncPath(k.dir); err != nil {
+		return 0, err
+	}
+	k.keys[id], k.current = key, id
+	return id, nil
+}
+
+// load reads every key file in the directory. k.lock must be held unless k is not shared yet.
+func (k *FileKeyProvider) load() error {
+	files, err := os.ReadDir(k.dir)
+	if err != nil {
+		return err
+	}
+	keys := make(map[uint32][]byte)
+	var current uint32
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != keyExt {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), keyExt), 10, 32)
+		if err != nil || id == 0 {
+			return fmt.Errorf("invalid key file name. should be a positive integer: %s", file.Name())
+		}
+		key, err := os.ReadFile(filepath.Join(k.dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		if _, err = aes.NewCipher(key); err != nil {
+			return fmt.Errorf("invalid key file %s: %w", file.Name(), err)
+		}
+		keys[uint32(id)] = key
+		current = max(current, uint32(id))
+	}
+	k.keys, k.current = keys, current
+	return nil
+}
+
+// keyring caches the AES-GCM ciphers of a KeyProvider's keys. A nil keyring encrypts nothing.
+type keyring struct {
+	provider KeyProvider
+	lock     sync.Mutex
+	aeads    map[uint32]cipher.AEAD
+}
+
+func newKeyring(provider KeyProvider) *keyring {
+	if provider == nil {
+		return nil
+	}
+	return &keyring{provider: provider, aeads: make(map[uint32]cipher.AEAD)}
+}
+
+// current returns the id and cipher of the key new data is encrypted with.
+func (k *keyring) current() (uint32, cipher.AEAD, error) {
+	id, key, err := k.provider.CurrentKey()
+	if err != nil {
+		return 0, nil, err
+	}
+	if id == 0 {
+		return 0, nil, errors.New("current key id should be positive")
+	}
+	aead, err := k.cached(id, func() ([]byte, error) { return key, nil })
+	return id, aead, err
+}
+
+// aead returns the cipher of the key with the given id.
+func (k *keyring) aead(id uint32) (cipher.AEAD, error) {
+	if k == nil {
+		return nil, fmt.Errorf("%w: %d, encryption is not enabled", ErrKeyNotFound, id)
+	}
+	return k.cached(id, func() ([]byte, error) { return k.provider.Key(id) })
+}
+
+func (k *keyring) cached(id uint32, key func() ([]byte, error)) (cipher.AEAD, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if aead, ok := k.aeads[id]; ok {
+		return aead, nil
+	}
+	b, err := key()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(b)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k.aeads[id] = aead
+	return aead, nil
+}
+
+// encrypt encrypts plaintext with a random nonce, which is prepended to the result. additional is
+// authenticated but not encrypted.
+func encrypt(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	out := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out, plaintext, additional), nil
+}
+
+// decrypt reverses encrypt.
+func decrypt(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("sealed data is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additional)
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"github.com/vandathron/bcaster/internal/cfg"
+	"github.com/vandathron/bcaster/internal/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileKeyProvider(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	keys, err := NewFileKeyProvider(dir)
+	require.NoError(t, err)
+	id, first, err := keys.CurrentKey()
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), id)
+	require.Equal(t, keySize, len(first))
+
+	id, err = keys.Rotate()
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), id)
+
+	// keys survive reopening, the newest one being current
+	keys, err = NewFileKeyProvider(dir)
+	require.NoError(t, err)
+	id, second, err := keys.CurrentKey()
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), id)
+	require.NotEqual(t, first, second)
+	key, err := keys.Key(1)
+	require.NoError(t, err)
+	require.Equal(t, first, key)
+	_, err = keys.Key(3)
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "3.key"), []byte("too short"), 0600))
+	_, err = NewFileKeyProvider(dir)
+	require.Error(t, err)
+}
+
+func TestPartition_Encryption(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topic := "customer_created"
+	config := getPartitionConfig(dir)
+	keys, err := NewFileKeyProvider(filepath.Join(dir, "keys"))
+	require.NoError(t, err)
+
+	partition, err := NewEncryptedPartition(topic, config, keys)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = partition.Append(getTestMsg(i))
+		require.NoError(t, err)
+	}
+	_, err = keys.Rotate() // applies from the next segment
+	require.NoError(t, err)
+	partition.lock.Lock()
+	require.NoError(t, partition.roll())
+	partition.lock.Unlock()
+	_, _, err = partition.AppendBatch([]model.Msg{getTestMsg(5), getTestMsg(6)})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), partition.segments[0].meta.KeyID)
+	require.Equal(t, uint32(2), partition.segments[1].meta.KeyID)
+
+	for _, s := range partition.segments {
+		b, err := os.ReadFile(s.name + ".message")
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(b, []byte("customer_")), "plaintext in %s", s.name)
+	}
+	require.NoError(t, partition.Close())
+
+	// reopened, every segment is read with its own key, compacted ones included
+	config.Compact = true
+	partition, err = NewEncryptedPartition(topic, config, keys)
+	require.NoError(t, err)
+	_, err = partition.Append(getTestMsg(4)) // makes offset 4 compactable
+	require.NoError(t, err)
+	partition.lock.Lock()
+	require.NoError(t, partition.roll())
+	partition.lock.Unlock()
+	removed, err := partition.Compact()
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	msgs, err := partition.ReadRange(0, 10, 1024*1024)
+	require.NoError(t, err)
+	require.Equal(t, 7, len(msgs))
+	for i, msg := range msgs[:6] {
+		require.Equal(t, getTestMsg([]int{0, 1, 2, 3, 5, 6}[i]).Value, msg.Value)
+	}
+	require.NoError(t, partition.Close())
+
+	// without the keys encrypted records cannot be read
+	_, err = NewPartition(topic, config)
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestConsumer_Encryption(t *testing.T) {
+	dir := t.TempDir()
+	keys, err := NewFileKeyProvider(filepath.Join(dir, "keys"))
+	require.NoError(t, err)
+	d := NewConsumerDir(cfg.Consumer{Dir: dir})
+	d.keys = keys
+
+	s, err := d.CreateOffsetStore(0)
+	require.NoError(t, err)
+	off, err := s.Append([]byte("consumer"), []byte("topic_A-0"), 5)
+	require.NoError(t, err)
+	_, err = keys.Rotate() // slots written from now on use the new key
+	require.NoError(t, err)
+	_, err = s.Append([]byte("consumer"), []byte("topic_B-0"), 7)
+	require.NoError(t, err)
+	_, _, readOff, err := s.Read(off, false)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), readOff)
+	require.NoError(t, s.Close())
+
+	b, err := os.ReadFile(filepath.Join(dir, "0"+encryptedConsumerExt))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(b, []byte("topic_")))
+
+	stores, err := d.OpenOffsetStores()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(stores))
+	id, topic, readOff, err := stores[0].Read(off, true)
+	require.NoError(t, err)
+	require.Equal(t, []byte("consumer"), id)
+	require.Equal(t, []byte("topic_A-0"), topic)
+	require.Equal(t, uint64(6), readOff)
+	_, topic, _, err = stores[0].Read(off+1, true)
+	require.NoError(t, err)
+	require.Equal(t, []byte("topic_B-0"), topic)
+	require.NoError(t, stores[0].Close())
+
+	d.keys = nil
+	_, err = d.OpenOffsetStores()
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
@@ -0,0 +1,452 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/vandathron/bcaster/internal/model"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryEngine keeps logs, offset stores and topic metadata in memory, so a store can run without touching
+// the disk. Data outlives closing and reopening a store on the same engine but not the engine itself.
+type MemoryEngine struct {
+	lock           sync.Mutex
+	logs           map[string]*memoryLog
+	offsets        []*memoryOffsetStore
+	topics         map[string]TopicMeta
+	lastProducerID uint64
+	epochs         map[uint64]uint16
+}
+
+func NewMemoryEngine() *MemoryEngine {
+	return &MemoryEngine{
+		logs:   make(map[string]*memoryLog),
+		topics: make(map[string]TopicMeta),
+		epochs: make(map[uint64]uint16),
+	}
+}
+
+func (e *MemoryEngine) OpenLog(name string) (Log, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	l, ok := e.logs[name]
+	if !ok || l.isClosed() {
+		l = newMemoryLog(l)
+		e.logs[name] = l
+	}
+	return l, nil
+}
+
+func (e *MemoryEngine) OpenOffsetStores() ([]OffsetStore, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	stores := make([]OffsetStore, 0, len(e.offsets))
+	for _, s := range e.offsets {
+		stores = append(stores, s)
+	}
+	return stores, nil
+}
+
+func (e *MemoryEngine) CreateOffsetStore(baseOff uint32) (OffsetStore, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, s := range e.offsets {
+		if s.baseOff == baseOff {
+			return s, nil
+		}
+	}
+	s := &memoryOffsetStore{baseOff: baseOff}
+	e.offsets = append(e.offsets, s)
+	return s, nil
+}
+
+func (e *MemoryEngine) ReadTopicMeta(topic string) (TopicMeta, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	m, ok := e.topics[topic]
+	if !ok {
+		return TopicMeta{}, fmt.Errorf("%w: %s", ErrTopicNotFound, topic)
+	}
+	return m, nil
+}
+
+func (e *MemoryEngine) WriteTopicMeta(topic string, m TopicMeta) error {
+	if m.Partitions <= 0 {
+		return fmt.Errorf("topic should have at least one partition: %d", m.Partitions)
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.topics[topic] = m
+	return nil
+}
+
+func (e *MemoryEngine) Topics() ([]string, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	topics := make([]string, 0, len(e.topics))
+	for topic := range e.topics {
+		topics = append(topics, topic)
+	}
+	slices.Sort(topics)
+	return topics, nil
+}
+
+// MigrateLegacyLog reports false, topics in memory always have metadata.
+func (e *MemoryEngine) MigrateLegacyLog(string) (bool, error) {
+	return false, nil
+}
+
+func (e *MemoryEngine) NextProducerID() (uint64, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.lastProducerID++
+	return e.lastProducerID, nil
+}
+
+func (e *MemoryEngine) ProducerEpoch(id uint64) (uint16, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.epochs[id], nil
+}
+
+func (e *MemoryEngine) BumpProducerEpoch(id uint64) (uint16, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if id == 0 || id > e.lastProducerID {
+		return 0, fmt.Errorf("%w: %d", ErrProducerNotFound, id)
+	}
+	if e.epochs[id] == math.MaxUint16 {
+		return 0, fmt.Errorf("producer %d has no epoch left", id)
+	}
+	e.epochs[id]++
+	return e.epochs[id], nil
+}
+
+func (e *MemoryEngine) Close() error {
+	return nil
+}
+
+type memoryLog struct {
+	lock       sync.RWMutex
+	start      uint64 // offset of msgs[0]
+	msgs       []model.Msg
+	producers  *producerStates
+	stop       chan struct{}
+	closeOnce  sync.Once
+	notifyLock sync.Mutex
+	appended   chan struct{}
+}
+
+// newMemoryLog returns a log holding the messages of prev, which may be nil.
+func newMemoryLog(prev *memoryLog) *memoryLog {
+	l := &memoryLog{producers: newProducerStates(), stop: make(chan struct{}), appended: make(chan struct{})}
+	if prev != nil {
+		prev.lock.RLock()
+		l.start, l.msgs, l.producers = prev.start, prev.msgs, prev.producers
+		prev.lock.RUnlock()
+	}
+	return l
+}
+
+func (l *memoryLog) Append(msg model.Msg) (uint64, error) {
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	l.lock.Lock()
+	if l.isClosed() {
+		l.lock.Unlock()
+		return 0, ErrPartitionClosed
+	}
+	msg = cloneMsg(msg)
+	msg.Offset = l.start + uint64(len(l.msgs))
+	l.msgs = append(l.msgs, msg)
+	l.lock.Unlock()
+	l.notifyAppend()
+	return msg.Offset, nil
+}
+
+func (l *memoryLog) AppendIdempotent(producer model.Producer, msgs []model.Msg) (first, last uint64, err error) {
+	if len(msgs) == 0 {
+		return 0, 0, ErrEmptyBatch
+	}
+	now := time.Now()
+	l.lock.Lock()
+	if l.isClosed() {
+		l.lock.Unlock()
+		return 0, 0, ErrPartitionClosed
+	}
+	dup, err := l.producers.check(producer, len(msgs))
+	if err != nil || dup != nil {
+		l.lock.Unlock()
+		if err != nil {
+			return 0, 0, err
+		}
+		return dup.firstOffset, dup.lastOffset, nil
+	}
+
+	first = l.end()
+	for i, msg := range msgs {
+		msg = cloneMsg(msg)
+		if msg.Timestamp.IsZero() {
+			msg.Timestamp = now
+		}
+		msg.Offset = l.end()
+		msg.Producer = producer
+		msg.Producer.Sequence = producer.Sequence + int32(i)
+		l.msgs = append(l.msgs, msg)
+		l.producers.update(msg)
+	}
+	last = l.end() - 1
+	l.lock.Unlock()
+	l.notifyAppend()
+	return first, last, nil
+}
+
+func (l *memoryLog) WriteMarker(producer model.Producer, control model.Control) error {
+	l.lock.Lock()
+	if l.isClosed() {
+		l.lock.Unlock()
+		return ErrPartitionClosed
+	}
+	open, err := l.producers.checkMarker(producer, control)
+	if err != nil || !open {
+		l.lock.Unlock()
+		return err
+	}
+	marker := markerMsg(producer, control)
+	marker.Timestamp = time.Now()
+	marker.Offset = l.end()
+	l.msgs = append(l.msgs, marker)
+	l.producers.update(marker)
+	l.lock.Unlock()
+	l.notifyAppend()
+	return nil
+}
+
+func (l *memoryLog) LastStableOffset() uint64 {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.producers.firstOpenOffset(l.end())
+}
+
+func (l *memoryLog) Aborted(msg *model.Msg) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.producers.isAborted(msg)
+}
+
+func (l *memoryLog) Read(offset uint64) (*model.Msg, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if offset < l.start || offset >= l.end() {
+		return nil, l.outOfRange(offset)
+	}
+	msg := cloneMsg(l.msgs[offset-l.start])
+	return &msg, nil
+}
+
+func (l *memoryLog) ReadRange(from uint64, maxMessages int, maxBytes int) ([]*model.Msg, error) {
+	if maxMessages <= 0 {
+		return nil, fmt.Errorf("max messages should be positive: %d", maxMessages)
+	}
+
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if from < l.start || from >= l.end() {
+		return nil, l.outOfRange(from)
+	}
+	var msgs []*model.Msg
+	var used uint64
+	for _, msg := range l.msgs[from-l.start:] {
+		size := uint64(recordSize(msg)) + msgHeaderWidth // counted like a frame in a message file
+		if len(msgs) == maxMessages || (len(msgs) > 0 && used+size > uint64(max(maxBytes, 0))) {
+			break
+		}
+		msg = cloneMsg(msg)
+		msgs = append(msgs, &msg)
+		used += size
+	}
+	return msgs, nil
+}
+
+func (l *memoryLog) TruncateTo(offset uint64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if offset < l.start {
+		return fmt.Errorf("cannot truncate to offset %d before the first offset %d", offset, l.start)
+	}
+	if offset < l.end() {
+		l.msgs = slices.Clip(l.msgs[:offset-l.start]) // clipped so appends do not overwrite a reopened log's messages
+		l.producers = newProducerStates()             // forget the sequences of removed messages
+		for _, msg := range l.msgs {
+			if msg.Producer.ID != 0 {
+				l.producers.update(msg)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *memoryLog) StartOffset() uint64 {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.start
+}
+
+func (l *memoryLog) HighWatermark() uint64 {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.end()
+}
+
+func (l *memoryLog) Size() uint64 {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	var size uint64
+	for _, msg := range l.msgs {
+		size += uint64(recordSize(msg)) + msgHeaderWidth
+	}
+	return size
+}
+
+func (l *memoryLog) WaitForOffset(ctx context.Context, offset uint64) error {
+	for {
+		l.notifyLock.Lock()
+		appended := l.appended // taken before checking so an append in between is not missed
+		l.notifyLock.Unlock()
+
+		if l.HighWatermark() > offset {
+			return nil
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.stop:
+			return ErrPartitionClosed
+		}
+	}
+}
+
+func (l *memoryLog) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.stop)
+	})
+	return nil
+}
+
+func (l *memoryLog) end() uint64 {
+	return l.start + uint64(len(l.msgs))
+}
+
+func (l *memoryLog) outOfRange(offset uint64) error {
+	return &OffsetOutOfRangeError{Offset: offset, Start: l.start, End: l.end()}
+}
+
+func (l *memoryLog) isClosed() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *memoryLog) notifyAppend() {
+	l.notifyLock.Lock()
+	close(l.appended)
+	l.appended = make(chan struct{})
+	l.notifyLock.Unlock()
+}
+
+// cloneMsg copies the byte slices of msg so neither the caller nor the log sees the other's changes.
+func cloneMsg(msg model.Msg) model.Msg {
+	msg.Key = bytes.Clone(msg.Key)
+	msg.Value = bytes.Clone(msg.Value)
+	if msg.Headers != nil {
+		headers := make([]model.Header, len(msg.Headers))
+		for i, h := range msg.Headers {
+			headers[i] = model.Header{Key: h.Key, Value: bytes.Clone(h.Value)}
+		}
+		msg.Headers = headers
+	}
+	return msg
+}
+
+type memoryOffsetStore struct {
+	lock    sync.Mutex
+	baseOff uint32
+	slots   []memoryOffsetSlot
+}
+
+type memoryOffsetSlot struct {
+	id      []byte
+	topic   []byte
+	readOff uint64
+}
+
+func (s *memoryOffsetStore) Append(id []byte, topic []byte, readOff uint64) (uint32, error) {
+	if err := validateOffsetSlot(id, topic); err != nil {
+		return 0, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.slots = append(s.slots, memoryOffsetSlot{id: bytes.Clone(id), topic: bytes.Clone(topic), readOff: readOff})
+	return s.baseOff + uint32(len(s.slots)-1), nil
+}
+
+func (s *memoryOffsetStore) WriteAt(off uint32, id []byte, topic []byte, readOff uint64) error {
+	if err := validateOffsetSlot(id, topic); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if off < s.baseOff || off >= s.baseOff+uint32(len(s.slots)) {
+		return fmt.Errorf("invalid offset %v. Last written offset: %v", off, s.baseOff+uint32(len(s.slots))-1)
+	}
+	s.slots[off-s.baseOff] = memoryOffsetSlot{id: bytes.Clone(id), topic: bytes.Clone(topic), readOff: readOff}
+	return nil
+}
+
+func (s *memoryOffsetStore) Read(off uint32, ignoreOff bool) (id []byte, topic []byte, readOff uint64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if off < s.baseOff || off >= s.baseOff+uint32(len(s.slots)) {
+		return nil, nil, 0, fmt.Errorf("%w at offset %d", ErrConsumerNotFound, off)
+	}
+	slot := &s.slots[off-s.baseOff]
+	id, topic, readOff = bytes.Clone(slot.id), bytes.Clone(slot.topic), slot.readOff
+	if !ignoreOff {
+		slot.readOff = readOff + 1
+	}
+	return id, topic, readOff, nil
+}
+
+func (s *memoryOffsetStore) BaseOff() uint32 {
+	return s.baseOff
+}
+
+func (s *memoryOffsetStore) LatestCommitedOff() uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.baseOff + uint32(len(s.slots)) - 1
+}
+
+func (s *memoryOffsetStore) Close() error {
+	return nil
+}
+
+// validateOffsetSlot applies the limits of a consumer file so both engines accept the same consumers.
+func validateOffsetSlot(id []byte, topic []byte) error {
+	if len(id) > IdSize {
+		return fmt.Errorf("ID of length %v exceeds maximum size of %v", len(id), IdSize)
+	}
+	if len(topic) > TopicSize {
+		return fmt.Errorf("topic of size %v exceeds max size of %v", len(topic), TopicSize)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"github.com/vandathron/bcaster/internal/model"
+	"testing"
+	"time"
+)
+
+func TestMemoryEngine_Log(t *testing.T) {
+	engine := NewMemoryEngine()
+	log, err := engine.OpenLog("topic_A-0")
+	require.NoError(t, err)
+
+	value := []byte("hello world 0")
+	for i := 0; i < 10; i++ {
+		off, err := log.Append(model.Msg{Value: value})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+		value = []byte(fmt.Sprintf("hello world %d", i+1))
+	}
+	require.Equal(t, uint64(0), log.StartOffset())
+	require.Equal(t, uint64(10), log.HighWatermark())
+
+	msg, err := log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), msg.Offset)
+	require.Equal(t, []byte("hello world 3"), msg.Value)
+	require.False(t, msg.Timestamp.IsZero())
+	msg.Value[0] = 'j' // readers get their own copy
+	msg, err = log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world 3"), msg.Value)
+
+	_, err = log.Read(10)
+	var rangeErr *OffsetOutOfRangeError
+	require.ErrorAs(t, err, &rangeErr)
+	require.Equal(t, OffsetOutOfRangeError{Offset: 10, Start: 0, End: 10}, *rangeErr)
+
+	msgs, err := log.ReadRange(2, 3, 1024)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(msgs))
+	require.Equal(t, uint64(4), msgs[2].Offset)
+	msgs, err = log.ReadRange(2, 3, 1) // a budget smaller than one message still returns it
+	require.NoError(t, err)
+	require.Equal(t, 1, len(msgs))
+
+	require.NoError(t, log.TruncateTo(5))
+	require.Equal(t, uint64(5), log.HighWatermark())
+	off, err := log.Append(model.Msg{Value: []byte("after truncate")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, log.TruncateTo(0))
+	require.Equal(t, uint64(0), log.HighWatermark())
+
+	producer := model.Producer{ID: 1}
+	_, _, err = log.AppendIdempotent(producer, []model.Msg{{Value: value, Transactional: true}})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), log.LastStableOffset())
+	require.NoError(t, log.WriteMarker(producer, model.ControlAbort))
+	require.Equal(t, uint64(2), log.LastStableOffset())
+	msg, err = log.Read(0)
+	require.NoError(t, err)
+	require.True(t, log.Aborted(msg))
+}
+
+func TestMemoryEngine_WaitAndReopen(t *testing.T) {
+	engine := NewMemoryEngine()
+	log, err := engine.OpenLog("topic_A-0")
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- log.WaitForOffset(context.Background(), 0)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_, err = log.Append(model.Msg{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+
+	go func() {
+		done <- log.WaitForOffset(context.Background(), 1)
+	}()
+	require.NoError(t, log.Close())
+	require.ErrorIs(t, <-done, ErrPartitionClosed)
+	_, err = log.Append(model.Msg{Value: []byte("hello world")})
+	require.ErrorIs(t, err, ErrPartitionClosed)
+
+	// reopening keeps the messages
+	log, err = engine.OpenLog("topic_A-0")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), log.HighWatermark())
+	off, err := log.Append(model.Msg{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	_, err = engine.ReadTopicMeta("topic_A")
+	require.ErrorIs(t, err, ErrTopicNotFound)
+	require.NoError(t, engine.WriteTopicMeta("topic_A", TopicMeta{Partitions: 2}))
+	meta, err := engine.ReadTopicMeta("topic_A")
+	require.NoError(t, err)
+	require.Equal(t, 2, meta.Partitions)
+}
+
+func TestMemoryEngine_OffsetStore(t *testing.T) {
+	engine := NewMemoryEngine()
+	s, err := engine.CreateOffsetStore(10)
+	require.NoError(t, err)
+
+	off, err := s.Append([]byte("consumer"), []byte("topic_A-0"), 5)
+	require.NoError(t, err)
+	require.Equal(t, uint32(10), off)
+	require.Equal(t, uint32(10), s.LatestCommitedOff())
+
+	id, topic, readOff, err := s.Read(10, false)
+	require.NoError(t, err)
+	require.Equal(t, []byte("consumer"), id)
+	require.Equal(t, []byte("topic_A-0"), topic)
+	require.Equal(t, uint64(5), readOff)
+	_, _, readOff, err = s.Read(10, true)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), readOff)
+
+	require.NoError(t, s.WriteAt(10, []byte{}, []byte{}, 6))
+	require.Error(t, s.WriteAt(11, []byte{}, []byte{}, 6))
+	_, _, _, err = s.Read(11, true)
+	require.ErrorIs(t, err, ErrConsumerNotFound)
+
+	stores, err := engine.OpenOffsetStores()
+	require.NoError(t, err)
+	require.Equal(t, []OffsetStore{s}, stores)
+}
@@ -4,15 +4,20 @@ import (
 	"bufio"
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
 	"io"
 	"os"
 	"sync"
 )
 
 const (
-	msgLenWidth = 8 // 8 bytes to hold the value of the message length
+	msgLenWidth    = 8                         // 8 bytes to hold the value of the message length
+	msgCrcWidth    = 4                         // 4 bytes to hold the CRC32C checksum of the message
+	msgHeaderWidth = msgLenWidth + msgCrcWidth // Every message is prefixed by its length and checksum
 )
 
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type LogFileConfig struct {
 }
 
@@ -48,15 +53,15 @@ func (m *msgFile) Append(data []byte) (pos uint64, err error) {
 	m.lck.Lock()
 	defer m.lck.Unlock()
 	dataLen := len(data)
-	entryWidth := dataLen + msgLenWidth
+	entryWidth := dataLen + msgHeaderWidth
 	pos = m.currSize // new entry pos
 
 	if m.currSize+uint64(entryWidth) > m.maxFileSize {
-		return pos, io.EOF
+		return pos, ErrSegmentFull
 	}
 
-	// Write data length (8 bytes) to temp storage
-	err = binary.Write(m.tempStorage, binary.BigEndian, uint64(dataLen))
+	// Write data length (8 bytes) and checksum (4 bytes) to temp storage
+	_, err = m.tempStorage.Write(frameHeader(data))
 	if err != nil {
 		return pos, err
 	}
@@ -84,23 +89,166 @@ func (m *msgFile) Read(pos uint64) ([]byte, error) {
 		return nil, err
 	}
 
-	msgSizeBytes := make([]byte, msgLenWidth)
-	_, err = m.file.ReadAt(msgSizeBytes, int64(pos))
+	if pos+msgHeaderWidth > m.currSize {
+		return nil, &CorruptRecordError{Pos: pos, Reason: "truncated header"}
+	}
+
+	header := make([]byte, msgHeaderWidth)
+	_, err = m.file.ReadAt(header, int64(pos))
 	if err != nil {
 		return nil, err
 	}
-	msgSizeVal := binary.BigEndian.Uint64(msgSizeBytes)
+	msgSizeVal := binary.BigEndian.Uint64(header[:msgLenWidth])
+	if msgSizeVal > m.currSize-pos-msgHeaderWidth { // guards against allocating from a damaged length field
+		return nil, &CorruptRecordError{Pos: pos, Reason: "length exceeds file size"}
+	}
 	msg := make([]byte, msgSizeVal)
 
-	_, err = m.file.ReadAt(msg, int64(pos+msgLenWidth))
+	_, err = m.file.ReadAt(msg, int64(pos+msgHeaderWidth))
 	if err != nil {
 		return nil, err
 	}
 
+	if checksum(header[:msgLenWidth], msg) != binary.BigEndian.Uint32(header[msgLenWidth:]) {
+		return nil, &CorruptRecordError{Pos: pos, Reason: "checksum mismatch"}
+	}
+
 	return msg, err
 }
 
+// checksum computes the CRC32C of a message's length prefix and data.
+func checksum(lenBytes, data []byte) uint32 {
+	return crc32.Update(crc32.Checksum(lenBytes, crcTable), crcTable, data)
+}
+
+// AppendBatch writes the longest prefix of records that fits in the file with a single write and returns
+// their positions. ErrSegmentFull is returned when not every record fit.
+func (m *msgFile) AppendBatch(records [][]byte) (positions []uint64, err error) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+	if err = m.tempStorage.Flush(); err != nil { // keep earlier appends ahead of the batch
+		return nil, err
+	}
+
+	var buf []byte
+	size := m.currSize
+	for _, data := range records {
+		entryWidth := uint64(len(data)) + msgHeaderWidth
+		if size+entryWidth > m.maxFileSize {
+			break
+		}
+		buf = append(buf, frameHeader(data)...)
+		buf = append(buf, data...)
+		positions = append(positions, size)
+		size += entryWidth
+	}
+
+	if len(buf) > 0 {
+		if _, err = m.file.Write(buf); err != nil {
+			return nil, err
+		}
+	}
+	m.currSize = size
+	if len(positions) < len(records) {
+		return positions, ErrSegmentFull
+	}
+	return positions, nil
+}
+
+// frameHeader returns the length and checksum prefix written ahead of data.
+func frameHeader(data []byte) []byte {
+	header := make([]byte, msgHeaderWidth)
+	binary.BigEndian.PutUint64(header[:msgLenWidth], uint64(len(data)))
+	binary.BigEndian.PutUint32(header[msgLenWidth:], checksum(header[:msgLenWidth], data))
+	return header
+}
+
+// ReadFrames reads the messages stored from pos onwards with a single read of up to maxBytes. The first
+// message is returned even when it is larger than maxBytes, while a later one cut off by the limit is left
+// for the next call.
+func (m *msgFile) ReadFrames(pos, maxBytes uint64) ([][]byte, error) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	if pos >= m.currSize {
+		return nil, io.EOF
+	}
+	if err := m.tempStorage.Flush(); err != nil {
+		return nil, err
+	}
+	if pos+msgHeaderWidth > m.currSize {
+		return nil, &CorruptRecordError{Pos: pos, Reason: "truncated header"}
+	}
+
+	n := max(min(maxBytes, m.currSize-pos), msgHeaderWidth)
+	buf := make([]byte, n)
+	if _, err := m.file.ReadAt(buf, int64(pos)); err != nil {
+		return nil, err
+	}
+
+	var frames [][]byte
+	var off uint64
+	for off+msgHeaderWidth <= n {
+		framePos := pos + off
+		msgSizeVal := binary.BigEndian.Uint64(buf[off : off+msgLenWidth])
+		if msgSizeVal > m.currSize-framePos-msgHeaderWidth {
+			return nil, &CorruptRecordError{Pos: framePos, Reason: "length exceeds file size"}
+		}
+		end := off + msgHeaderWidth + msgSizeVal
+		if end > n {
+			if len(frames) > 0 {
+				break
+			}
+			// the first message alone exceeds maxBytes, read the rest of it
+			buf = append(buf, make([]byte, end-n)...)
+			if _, err := m.file.ReadAt(buf[n:], int64(pos+n)); err != nil {
+				return nil, err
+			}
+			n = end
+		}
+
+		data := buf[off+msgHeaderWidth : end]
+		if checksum(buf[off:off+msgLenWidth], data) != binary.BigEndian.Uint32(buf[off+msgLenWidth:off+msgHeaderWidth]) {
+			return nil, &CorruptRecordError{Pos: framePos, Reason: "checksum mismatch"}
+		}
+		frames = append(frames, data)
+		off = end
+	}
+	return frames, nil
+}
+
+// flush hands buffered messages to the OS.
+func (m *msgFile) flush() error {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+	return m.tempStorage.Flush()
+}
+
+// Sync flushes buffered messages and commits the file to stable storage.
+func (m *msgFile) Sync() error {
+	if err := m.flush(); err != nil {
+		return err
+	}
+	return m.file.Sync() // outside the lock so appends are not held up by the disk
+}
+
+// truncate discards everything from size onwards.
+func (m *msgFile) truncate(size uint64) error {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+	if err := m.tempStorage.Flush(); err != nil {
+		return err
+	}
+	if err := m.file.Truncate(int64(size)); err != nil {
+		return err
+	}
+	m.currSize = size
+	return m.file.Sync()
+}
+
 func (m *msgFile) CurrentSize() uint64 {
+	m.lck.Lock()
+	defer m.lck.Unlock()
 	return m.currSize
 }
 
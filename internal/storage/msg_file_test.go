@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -22,7 +23,7 @@ func TestAppend_And_Read(t *testing.T) {
 
 	for i := 0; i < 10; i++ {
 		msg := []byte(fmt.Sprintf("I love golang!, %d", i))
-		entryWidth := len(msg) + msgLenWidth
+		entryWidth := len(msg) + msgHeaderWidth
 		testAppend(t, log, msg, int64(currentPos))
 		msgBytes, err := log.Read(uint64(currentPos))
 		require.NoError(t, err)
@@ -38,3 +39,67 @@ func testAppend(t *testing.T, log *msgFile, msg []byte, expectedPos int64) {
 	require.NoError(t, err)
 	require.Equal(t, uint64(expectedPos), pos)
 }
+
+func TestRead_CorruptRecord(t *testing.T) {
+	file, err := os.CreateTemp("", "test_corrupt")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	log, err := NewMsgFile(file.Name(), 1024)
+	require.NoError(t, err)
+	msg := []byte("I love golang!")
+	testAppend(t, log, msg, 0)
+	_, err = log.Read(0)
+	require.NoError(t, err)
+
+	// flip a bit in the message data
+	flipByte(t, file.Name(), msgHeaderWidth)
+	_, err = log.Read(0)
+	require.ErrorIs(t, err, ErrCorruptRecord)
+
+	// damaged length field should not be trusted
+	flipByte(t, file.Name(), 0)
+	_, err = log.Read(0)
+	var corruptErr *CorruptRecordError
+	require.ErrorAs(t, err, &corruptErr)
+	require.Equal(t, uint64(0), corruptErr.Pos)
+	require.NoError(t, file.Close())
+	require.NoError(t, log.Close())
+}
+
+func TestAppendBatch(t *testing.T) {
+	file, err := os.CreateTemp("", "test_append_batch")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	log, err := NewMsgFile(file.Name(), 100)
+	require.NoError(t, err)
+	testAppend(t, log, []byte("first"), 0)
+
+	// 17, 21 and 52 bytes framed; only the first two fit after the 17 bytes already written
+	records := [][]byte{[]byte("batch"), []byte("batch-one"), []byte(strings.Repeat("x", 40))}
+	positions, err := log.AppendBatch(records)
+	require.ErrorIs(t, err, ErrSegmentFull)
+	require.Equal(t, []uint64{17, 34}, positions)
+	require.Equal(t, uint64(55), log.CurrentSize())
+
+	for i, pos := range positions {
+		data, err := log.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, records[i], data)
+	}
+	require.NoError(t, file.Close())
+	require.NoError(t, log.Close())
+}
+
+// flipByte flips the bits of a single byte on disk, bypassing the append-only handle.
+func flipByte(t *testing.T, name string, pos int64) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0666)
+	require.NoError(t, err)
+	defer f.Close()
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, pos)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{^b[0]}, pos)
+	require.NoError(t, err)
+}
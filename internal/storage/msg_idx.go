@@ -2,16 +2,25 @@ package storage
 
 import (
 	"encoding/binary"
+	"fmt"
 	"github.com/tysonmote/gommap"
 	"github.com/vandathron/bcaster/internal/cfg"
 	"io"
+	"math"
 	"os"
+	"sort"
+	"sync"
 )
 
 const (
 	offsetWidth     = 8                         // offset value in index file should occupy 8 bytes in space
 	msgPosWidth     = 8                         // Message pos value in index file should occupy 8 bytes in space
 	indexEntryWidth = offsetWidth + msgPosWidth // Full index entry by logic should occupy 16 bytes
+
+	// A sparse index stores offsets relative to the segment's start offset and 4-byte positions
+	sparseOffsetWidth     = 4
+	sparseMsgPosWidth     = 4
+	sparseIndexEntryWidth = sparseOffsetWidth + sparseMsgPosWidth
 )
 
 type MsgIdx struct {
@@ -19,6 +28,7 @@ type MsgIdx struct {
 	mmap     gommap.MMap
 	currSize uint64
 	cfg      cfg.Index
+	lock     sync.RWMutex // entries are only written by the partition's writer, readers take the read lock
 }
 
 func NewIndex(fileName string, cfg cfg.Index) (*MsgIdx, error) {
@@ -48,45 +58,142 @@ func NewIndex(fileName string, cfg cfg.Index) (*MsgIdx, error) {
 }
 
 func (i *MsgIdx) Append(off uint64, pos uint64) error {
-	if indexEntryWidth+i.currSize > i.cfg.MaxSizeByte {
-		return io.EOF
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	width := i.entryWidth()
+	if width+i.currSize > i.cfg.MaxSizeByte {
+		return ErrSegmentFull
 	}
 
-	binary.BigEndian.PutUint64(i.mmap[i.currSize:i.currSize+offsetWidth], off)
-	binary.BigEndian.PutUint64(i.mmap[i.currSize+offsetWidth:i.currSize+indexEntryWidth], pos)
-	i.currSize += indexEntryWidth
+	if i.isSparse() {
+		relOff := off - i.cfg.StartOffset
+		if off < i.cfg.StartOffset || relOff > math.MaxUint32 || pos > math.MaxUint32 {
+			return fmt.Errorf("offset %d at pos %d cannot be held in a sparse index starting at %d", off, pos, i.cfg.StartOffset)
+		}
+		binary.BigEndian.PutUint32(i.mmap[i.currSize:i.currSize+sparseOffsetWidth], uint32(relOff))
+		binary.BigEndian.PutUint32(i.mmap[i.currSize+sparseOffsetWidth:i.currSize+width], uint32(pos))
+	} else {
+		binary.BigEndian.PutUint64(i.mmap[i.currSize:i.currSize+offsetWidth], off)
+		binary.BigEndian.PutUint64(i.mmap[i.currSize+offsetWidth:i.currSize+width], pos)
+	}
+	i.currSize += width
+	return nil
+}
 
-	err := i.mmap.Sync(gommap.MS_SYNC)
-	return err
+// Sync flushes appended entries to stable storage.
+func (i *MsgIdx) Sync() error {
+	return i.mmap.Sync(gommap.MS_SYNC)
 }
 
+// Read returns the position of the message at off, which must have an entry of its own.
 func (i *MsgIdx) Read(off uint64) (uint64, error) {
-	entryStartPos := off * indexEntryWidth
-	entryEndPos := entryStartPos + indexEntryWidth
-
-	if entryEndPos > i.currSize { // Check offset is within index entries
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	entryOff, pos, err := i.lookup(off)
+	if err != nil {
+		return 0, err
+	}
+	if entryOff != off { // Check offset is within index entries
 		return 0, io.EOF
 	}
+	return pos, nil
+}
 
-	entryPos := binary.BigEndian.Uint64(i.mmap[entryStartPos+offsetWidth : entryEndPos]) // Fetch entry position from index
-	return entryPos, nil
+// Lookup binary searches for the last entry at or before off. The message at off is found by scanning the
+// message file forward from the returned position.
+func (i *MsgIdx) Lookup(off uint64) (entryOff uint64, pos uint64, err error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.lookup(off)
+}
+
+func (i *MsgIdx) lookup(off uint64) (entryOff uint64, pos uint64, err error) {
+	n := i.entryCount()
+	e := sort.Search(int(n), func(e int) bool {
+		entryOff, _ := i.entryAt(uint64(e))
+		return entryOff > off
+	})
+	if e == 0 { // index is empty or off precedes the first entry
+		return 0, 0, io.EOF
+	}
+
+	entryOff, pos = i.entryAt(uint64(e - 1))
+	return entryOff, pos, nil
 }
 
 func (i *MsgIdx) LastEntry() (off uint64, pos uint64, err error) {
-	if indexEntryWidth > i.currSize { // Should have at least one entry
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	if i.entryWidth() > i.currSize { // Should have at least one entry
 		err = io.EOF
 		return
 	}
 
-	startPos := i.currSize - indexEntryWidth
+	off, pos = i.entryAt(i.entryCount() - 1)
+	return off, pos, nil
+}
+
+func (i *MsgIdx) isSparse() bool {
+	return i.cfg.IntervalByte > 0
+}
+
+func (i *MsgIdx) entryWidth() uint64 {
+	if i.isSparse() {
+		return sparseIndexEntryWidth
+	}
+	return indexEntryWidth
+}
+
+func (i *MsgIdx) entryCount() uint64 {
+	return i.currSize / i.entryWidth()
+}
 
+func (i *MsgIdx) entryAt(n uint64) (off uint64, pos uint64) {
+	startPos := n * i.entryWidth()
+	if i.isSparse() {
+		off = i.cfg.StartOffset + uint64(binary.BigEndian.Uint32(i.mmap[startPos:startPos+sparseOffsetWidth]))
+		pos = uint64(binary.BigEndian.Uint32(i.mmap[startPos+sparseOffsetWidth : startPos+sparseIndexEntryWidth]))
+		return off, pos
+	}
 	off = binary.BigEndian.Uint64(i.mmap[startPos : startPos+offsetWidth])
 	pos = binary.BigEndian.Uint64(i.mmap[startPos+offsetWidth : startPos+indexEntryWidth])
+	return off, pos
+}
 
-	return off, pos, nil
+// isConsistent reports whether the first n entries start at the head of the message file and increase
+// strictly in both offset and position. Offsets may have gaps left behind by compaction.
+func (i *MsgIdx) isConsistent(n uint64) bool {
+	var prevOff, prevPos uint64
+	for e := uint64(0); e < n; e++ {
+		off, pos := i.entryAt(e)
+		if e == 0 {
+			if off < i.cfg.StartOffset || pos != 0 {
+				return false
+			}
+		} else if pos <= prevPos || off <= prevOff {
+			return false
+		}
+		prevOff, prevPos = off, pos
+	}
+	return true
+}
+
+// truncate drops every entry from the nth onwards, zeroing them so they cannot resurface after a crash.
+func (i *MsgIdx) truncate(n uint64) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	newSize := n * i.entryWidth()
+	if newSize >= i.currSize {
+		return nil
+	}
+	clear(i.mmap[newSize:i.currSize])
+	i.currSize = newSize
+	return i.mmap.Sync(gommap.MS_SYNC)
 }
 
 func (i *MsgIdx) Close() error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
 	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil { // synchronously flush to file
 		return err
 	}
@@ -108,6 +215,14 @@ func (i *MsgIdx) Discard() error {
 	return os.Remove(i.file.Name())
 }
 
+// freeEntries returns how many more entries fit in the index.
+func (i *MsgIdx) freeEntries() uint64 {
+	if i.currSize >= i.cfg.MaxSizeByte {
+		return 0
+	}
+	return (i.cfg.MaxSizeByte - i.currSize) / i.entryWidth()
+}
+
 func (i *MsgIdx) IsMaxedOut() bool {
-	return i.currSize+indexEntryWidth >= i.cfg.MaxSizeByte
+	return i.currSize+i.entryWidth() >= i.cfg.MaxSizeByte
 }
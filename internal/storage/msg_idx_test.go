@@ -3,6 +3,7 @@ package storage
 import (
 	"github.com/stretchr/testify/require"
 	"github.com/vandathron/bcaster/internal/cfg"
+	"io"
 	"os"
 	"testing"
 )
@@ -89,3 +90,40 @@ func TestIndexRead(t *testing.T) {
 	require.Equal(t, int64(idxCfg.MaxSizeByte), idxSize.Size())
 	require.NoError(t, index.Close())
 }
+
+func TestSparseIndexLookup(t *testing.T) {
+	idxCfg := cfg.Index{MaxSizeByte: uint64(1024), StartOffset: 100, IntervalByte: 64}
+	file, err := os.CreateTemp("", "index_file_test")
+	require.NoError(t, err)
+	defer func(name string) {
+		file.Close()
+		os.Remove(name)
+	}(file.Name())
+
+	index, err := NewIndex(file.Name(), idxCfg)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ { // every 5th offset indexed
+		require.NoError(t, index.Append(uint64(100+i*5), uint64(i*500)))
+	}
+	require.Equal(t, uint64(10*sparseIndexEntryWidth), index.currSize)
+
+	_, _, err = index.Lookup(99)
+	require.Equal(t, io.EOF, err)
+	for i := 0; i < 50; i++ {
+		entryOff, pos, err := index.Lookup(uint64(100 + i))
+		require.NoError(t, err)
+		require.Equal(t, uint64(100+(i/5)*5), entryOff)
+		require.Equal(t, uint64((i/5)*500), pos)
+	}
+
+	pos, err := index.Read(105)
+	require.NoError(t, err)
+	require.Equal(t, uint64(500), pos)
+	_, err = index.Read(106) // not indexed
+	require.Equal(t, io.EOF, err)
+
+	require.Error(t, index.Append(99, 5000))              // before start offset
+	require.Error(t, index.Append(200, uint64(1)<<32+10)) // position too large for 4 bytes
+	require.True(t, index.isConsistent(index.entryCount()))
+	require.NoError(t, index.Close())
+}
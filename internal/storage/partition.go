@@ -3,13 +3,17 @@ package storage
 import (
 	"fmt"
 	"github.com/vandathron/bcaster/internal/cfg"
+	"github.com/vandathron/bcaster/internal/model"
 	"io"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Partition struct {
@@ -17,57 +21,69 @@ type Partition struct {
 	segments        []*Segment
 	writableSegment *Segment
 	cfg             cfg.Partition
+	lock            sync.Mutex    // serializes writers
+	segLock         sync.RWMutex  // guards segments and writableSegment, held exclusively to add, replace or remove a segment
+	cleanLock       sync.Mutex    // serializes retention and compaction
+	stop            chan struct{} // closed to stop the background goroutines and wake waiting readers
+	closeOnce       sync.Once
+	background      sync.WaitGroup
+	notifyLock      sync.Mutex
+	appended        chan struct{}   // closed and replaced whenever appended messages become readable
+	tier            *tiering        // nil unless EnableTiering was called
+	producers       *producerStates // changed holding both lock and producersLock, read holding either
+	producersLock   sync.RWMutex    // lets readers of transaction state skip waiting for writers
+	keys            *keyring        // nil unless records are encrypted
+	recordCache     *partitionCache // nil unless EnableRecordCache was called
+	recovery        RecoveryReport  // repairs made to the segments on open
 }
 
 func NewPartition(topic string, c cfg.Partition) (*Partition, error) {
+	return NewEncryptedPartition(topic, c, nil)
+}
+
+// NewEncryptedPartition opens a partition whose new segments encrypt their records with the current key of
+// keys, which also decrypts the existing ones. Segments keep the key they were created with, so rotating the
+// current key applies from the next segment. A nil keys leaves new segments unencrypted.
+func NewEncryptedPartition(topic string, c cfg.Partition, keys KeyProvider) (*Partition, error) {
 	partitionDir := filepath.Join(c.Dir, fmt.Sprintf("part_%s", topic))
 	if err := os.MkdirAll(partitionDir, 0750); err != nil {
 		return nil, err
 	}
 
-	segments, err := os.ReadDir(partitionDir) // Usually directory may contain messages & index, segment is just a logical name
+	if err := recoverCompaction(partitionDir); err != nil {
+		return nil, err
+	}
+
+	baseOffsets, err := segmentBaseOffsets(partitionDir) // Usually directory may contain messages & index, segment is just a logical name
 	if err != nil {
 		return nil, err
 	}
 	p := &Partition{
-		cfg:   c,
-		topic: topic,
+		cfg:      c,
+		topic:    topic,
+		stop:     make(chan struct{}),
+		appended: make(chan struct{}),
+		keys:     newKeyring(keys),
 	}
 
-	sort.Slice(segments, func(i, j int) bool {
-		parse := func(name string) int {
-			i, _ := strconv.Atoi(strings.TrimSuffix(name, path.Ext(name)))
-			return i
-		}
-		return parse(segments[i].Name()) < parse(segments[j].Name())
-	})
-
-	for i := 0; i < len(segments); i = i + 2 { // each segment has msg file and index file with same name. Makes sense to only get one of each.
-		segment := segments[i]
-		segName := strings.TrimSuffix(segment.Name(), path.Ext(segment.Name()))
-		if segName == "" {
-			return nil, fmt.Errorf("invalid segment name: %s", segment.Name())
-		}
-		startOffset, err := strconv.Atoi(segName)
-		if err != nil {
-			return nil, fmt.Errorf("invalid segment name. should be an integer: %s", segment.Name())
-		}
-
-		p.cfg.Segment.StartOffset = uint64(startOffset)
+	for _, baseOffset := range baseOffsets {
+		p.cfg.Segment.StartOffset = baseOffset
 
-		s, err := NewSegment(partitionDir, p.cfg.Segment)
+		s, err := newSegment(partitionDir, p.cfg.Segment, p.keys)
 
 		if err != nil {
+			_ = p.Close()
 			return nil, err
 		}
 
 		p.segments = append(p.segments, s)
 		p.writableSegment = s // Will assign last segment eventually as writable segment
+		p.recovery.add(s.Recovery())
 	}
 
-	if len(segments) == 0 { // indicates an empty partition
+	if len(baseOffsets) == 0 { // indicates an empty partition
 		p.cfg.Segment.StartOffset = uint64(0)
-		s, err := NewSegment(partitionDir, p.cfg.Segment)
+		s, err := newSegment(partitionDir, p.cfg.Segment, p.keys)
 
 		if err != nil {
 			return nil, err
@@ -76,24 +92,87 @@ func NewPartition(topic string, c cfg.Partition) (*Partition, error) {
 		p.writableSegment = s
 	}
 
+	if err = p.loadProducers(); err != nil {
+		_ = p.Close()
+		return nil, err
+	}
+
+	if p.cfg.RetentionCheckInterval > 0 || (p.cfg.Compact && p.cfg.CompactionInterval > 0) {
+		p.background.Add(1)
+		go p.runCleaner()
+	}
+	if p.cfg.Segment.SyncPolicy == cfg.SyncInterval && p.cfg.Segment.SyncInterval > 0 {
+		p.background.Add(1)
+		go p.runSyncer()
+	}
+
 	return p, nil
 }
 
-func (p *Partition) Append(msg []byte) (uint64, error) {
-	off, err := p.writableSegment.Append(msg)
+// segmentBaseOffsets returns the sorted base offsets of the segments in dir. Segments are paired by the
+// base offset in their file names so a missing .index or .message file does not shift the pairing.
+func segmentBaseOffsets(dir string) ([]uint64, error) {
+	files, err := os.ReadDir(dir)
 	if err != nil {
-		if err == io.EOF { // indicates a full segment and should create a new segment, then add/update writable segment
-			p.cfg.Segment.StartOffset = p.writableSegment.nextOffset
+		return nil, err
+	}
 
-			s, err := NewSegment(p.Name(), p.cfg.Segment)
+	seen := make(map[uint64]bool)
+	var baseOffsets []uint64
+	for _, file := range files {
+		ext := path.Ext(file.Name())
+		if file.IsDir() || (ext != ".index" && ext != ".message") {
+			continue
+		}
+		segName := strings.TrimSuffix(file.Name(), ext)
+		if segName == "" {
+			return nil, fmt.Errorf("invalid segment name: %s", file.Name())
+		}
+		baseOffset, err := strconv.ParseUint(segName, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid segment name. should be an integer: %s", file.Name())
+		}
+		if !seen[baseOffset] {
+			seen[baseOffset] = true
+			baseOffsets = append(baseOffsets, baseOffset)
+		}
+	}
 
-			if err != nil {
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	return baseOffsets, nil
+}
+
+// Append writes msg and returns its offset once the message is as durable as the sync policy requires.
+func (p *Partition) Append(msg model.Msg) (uint64, error) {
+	p.lock.Lock()
+	off, err := p.append(msg)
+	segment := p.writableSegment
+	p.lock.Unlock()
+	p.notifyAppend()
+	if err != nil {
+		return 0, err
+	}
+	return off, segment.waitDurable(off) // outside the lock so concurrent appends can join the same sync
+}
+
+func (p *Partition) append(msg model.Msg) (uint64, error) {
+	if err := p.checkFits([]model.Msg{msg}); err != nil {
+		return 0, err
+	}
+	if p.writableSegment.isExpired(time.Now()) {
+		if err := p.roll(); err != nil {
+			return 0, err
+		}
+	}
+	off, err := p.writableSegment.Append(msg)
+	if err != nil {
+		if err == ErrSegmentFull { // create a new segment, then add/update writable segment
+			if err := p.roll(); err != nil {
 				return 0, err
 			}
-
-			p.segments = append(p.segments, s)
-			p.writableSegment = s
-			return p.Append(msg)
+			return p.append(msg)
 		}
 		return 0, err
 	}
@@ -101,37 +180,382 @@ func (p *Partition) Append(msg []byte) (uint64, error) {
 	return off, nil
 }
 
-func (p *Partition) Read(offset uint64) (msg []byte, err error) {
-	segment := p.getOffsetSegment(offset)
-	if segment == nil {
-		return nil, io.EOF
+// AppendBatch writes msgs with contiguous offsets, rolling to new segments as they fill up, and returns the
+// first and last offsets once the batch is as durable as the sync policy requires.
+func (p *Partition) AppendBatch(msgs []model.Msg) (first, last uint64, err error) {
+	if len(msgs) == 0 {
+		return 0, 0, ErrEmptyBatch
 	}
 
-	return segment.Read(offset)
+	p.lock.Lock()
+	first, last, err = p.appendBatch(msgs)
+	segment := p.writableSegment
+	p.lock.Unlock()
+	p.notifyAppend() // messages written before a failure are readable too
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, last, segment.waitDurable(last)
 }
 
-func (p *Partition) getOffsetSegment(offset uint64) *Segment {
-	for _, segment := range p.segments {
-		if offset >= segment.cfg.StartOffset && offset < segment.nextOffset {
-			return segment
+// AppendIdempotent is like AppendBatch for msgs numbered by producer from producer.Sequence onwards. A retry
+// of a batch that was already appended returns the offsets it was appended at without appending it again.
+// Errors wrapping ErrOutOfOrderSequence, ErrDuplicateSequence or ErrProducerFenced reject a batch that does
+// not follow the producer's previous one.
+func (p *Partition) AppendIdempotent(producer model.Producer, msgs []model.Msg) (first, last uint64, err error) {
+	if len(msgs) == 0 {
+		return 0, 0, ErrEmptyBatch
+	}
+
+	p.lock.Lock()
+	dup, err := p.producers.check(producer, len(msgs))
+	if err != nil || dup != nil {
+		segment := p.writableSegment
+		p.lock.Unlock()
+		if err != nil {
+			return 0, 0, err
+		}
+		return dup.firstOffset, dup.lastOffset, segment.waitDurable(dup.lastOffset)
+	}
+
+	batch := make([]model.Msg, len(msgs))
+	for i, msg := range msgs {
+		msg.Producer = producer
+		msg.Producer.Sequence = producer.Sequence + int32(i)
+		batch[i] = msg
+	}
+	start := p.writableSegment.nextOffset
+	first, last, err = p.appendBatch(batch)
+	p.producersLock.Lock()
+	for i, msg := range batch[:p.writableSegment.nextOffset-start] { // a prefix written before a failure counts too
+		msg.Offset = start + uint64(i)
+		p.producers.update(msg)
+	}
+	p.producersLock.Unlock()
+	segment := p.writableSegment
+	p.lock.Unlock()
+	p.notifyAppend()
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, last, segment.waitDurable(last)
+}
+
+// appendBatch writes msgs, rolling to new segments as they fill up. p.lock must be held.
+func (p *Partition) appendBatch(msgs []model.Msg) (first, last uint64, err error) {
+	if err = p.checkFits(msgs); err != nil {
+		return 0, 0, err
+	}
+	if p.writableSegment.isExpired(time.Now()) {
+		if err = p.roll(); err != nil {
+			return 0, 0, err
+		}
+	}
+	first = p.writableSegment.nextOffset
+	for len(msgs) > 0 {
+		var n int
+		n, err = p.writableSegment.AppendBatch(msgs)
+		msgs = msgs[n:]
+		if err == ErrSegmentFull {
+			err = p.roll()
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return first, p.writableSegment.nextOffset - 1, nil
+}
+
+// checkFits fails when one of msgs cannot be encoded or does not fit in an empty segment, so a batch is
+// rejected before any of it is written rather than part way through.
+func (p *Partition) checkFits(msgs []model.Msg) error {
+	for _, msg := range msgs {
+		if err := checkEncodable(msg); err != nil {
+			return err
+		}
+		width := uint64(recordSize(msg)) + msgHeaderWidth
+		if p.keys != nil { // new segments may be encrypted
+			width += encryptionOverhead
+		}
+		if width > p.cfg.Segment.MaxMsgSizeByte {
+			return fmt.Errorf("%w: %d bytes, segments hold %d", ErrMessageTooLarge, width, p.cfg.Segment.MaxMsgSizeByte)
 		}
 	}
 	return nil
 }
 
+// roll replaces the full writable segment with a new one starting at its next offset.
+func (p *Partition) roll() error {
+	if p.writableSegment.nextOffset == p.writableSegment.cfg.StartOffset {
+		return ErrMessageTooLarge // the writable segment is empty, so a new one would not fit the message either
+	}
+	if p.cfg.Segment.SyncPolicy != cfg.SyncOS {
+		if err := p.writableSegment.sync(); err != nil { // closed segments are always fully durable
+			return err
+		}
+	}
+	c := p.cfg.Segment
+	c.StartOffset = p.writableSegment.nextOffset
+
+	s, err := newSegment(p.Name(), c, p.keys)
+	if err != nil {
+		return err
+	}
+
+	s.recordCache = p.recordCache
+	p.segLock.Lock()
+	p.segments = append(p.segments, s)
+	p.writableSegment.recordCache = nil // closed segments are no longer appended to
+	p.writableSegment = s
+	p.segLock.Unlock()
+	if len(p.producers.producers) > 0 { // bounds how much of the log loading the producers replays
+		return p.snapshotProducers()
+	}
+	return nil
+}
+
+// TruncateTo removes every message at or after offset, which becomes the next offset appended. Newer
+// segments are deleted first, so a crash part way through leaves a consistent log to truncate again.
+func (p *Partition) TruncateTo(offset uint64) error {
+	p.cleanLock.Lock()
+	defer p.cleanLock.Unlock()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.segLock.Lock()
+	defer p.segLock.Unlock()
+
+	if start := p.segments[0].cfg.StartOffset; offset < start {
+		return fmt.Errorf("cannot truncate to offset %d before the first local offset %d", offset, start)
+	}
+	for last := len(p.segments) - 1; last > 0 && p.segments[last].cfg.StartOffset >= offset; last-- {
+		if err := p.segments[last].Remove(); err != nil {
+			return err
+		}
+		p.segments = p.segments[:last]
+	}
+	p.writableSegment = p.segments[len(p.segments)-1]
+	p.writableSegment.recordCache = p.recordCache
+	if err := p.writableSegment.truncateTo(offset); err != nil {
+		return err
+	}
+	p.recordCache.purge(offset, math.MaxUint64)
+	if err := p.loadProducers(); err != nil { // forget the sequences of removed messages
+		return err
+	}
+	p.producersLock.Lock()
+	p.producers.prune(p.startOffset())
+	p.producersLock.Unlock()
+	return nil
+}
+
+// Read returns the message at offset, or the first one after it when offset was removed by compaction.
+// An *OffsetOutOfRangeError is returned when there is no such message.
+func (p *Partition) Read(offset uint64) (msg *model.Msg, err error) {
+	p.segLock.RLock()
+	defer p.segLock.RUnlock()
+	if msg, ok := p.recordCache.get(offset); ok {
+		return msg, nil
+	}
+	msg, err = p.read(offset)
+	if err == nil {
+		p.recordCache.put(msg)
+	}
+	return msg, err
+}
+
+// read looks offset up in the segments. p.segLock must be held.
+func (p *Partition) read(offset uint64) (msg *model.Msg, err error) {
+	i := p.segmentIndex(offset)
+	if i < 0 && p.tier != nil && p.tier.holds(offset) { // offset precedes the local segments but was offloaded
+		if msg, err = p.tier.read(offset); err != io.EOF {
+			return msg, err
+		}
+		i = 0
+	}
+	for ; i >= 0 && i < len(p.segments); i++ {
+		msg, err = p.segments[i].Read(offset)
+		if err != io.EOF { // offset may have been compacted away, continue with the following segment
+			return msg, err
+		}
+	}
+	return nil, p.outOfRange(offset)
+}
+
+// ReadRange returns up to maxMessages consecutive messages from offset from onwards, spanning segments,
+// whose combined size stays within maxBytes. The first message is returned even when it alone exceeds
+// maxBytes.
+func (p *Partition) ReadRange(from uint64, maxMessages int, maxBytes int) ([]*model.Msg, error) {
+	if maxMessages <= 0 {
+		return nil, fmt.Errorf("max messages should be positive: %d", maxMessages)
+	}
+
+	p.segLock.RLock()
+	defer p.segLock.RUnlock()
+	budget := uint64(max(maxBytes, 0))
+	msgs, used, full := p.cachedRange(from, maxMessages, budget)
+	if full {
+		return msgs, nil
+	}
+	if len(msgs) > 0 {
+		from = msgs[len(msgs)-1].Offset + 1
+	}
+
+	cached := len(msgs)
+	err := io.EOF // segments are read until one stops short of its end because a limit was reached
+	i := p.segmentIndex(from)
+	if i < 0 && p.tier != nil && p.tier.holds(from) {
+		var tierMsgs []*model.Msg
+		tierMsgs, used, err = p.tier.readRange(from, maxMessages-len(msgs), budget, used)
+		msgs = append(msgs, tierMsgs...)
+		i = 0
+	}
+	for ; err == io.EOF && i >= 0 && i < len(p.segments); i++ {
+		var segMsgs []*model.Msg
+		segMsgs, used, err = p.segments[i].readRange(from, maxMessages-len(msgs), budget, used)
+		msgs = append(msgs, segMsgs...)
+	}
+	if err != nil && err != io.EOF { // io.EOF just means the end of the log was reached
+		return nil, err
+	}
+	for _, msg := range msgs[cached:] {
+		p.recordCache.put(msg)
+	}
+
+	if len(msgs) == 0 {
+		return nil, p.outOfRange(from)
+	}
+	return msgs, nil
+}
+
+// cachedRange returns the cached messages at consecutive offsets from onwards, within the limits of
+// ReadRange, reporting whether a limit was reached.
+func (p *Partition) cachedRange(from uint64, maxMessages int, maxBytes uint64) (msgs []*model.Msg, used uint64, full bool) {
+	for off := from; len(msgs) < maxMessages; off++ {
+		msg, ok := p.recordCache.get(off)
+		if !ok {
+			return msgs, used, false
+		}
+		width := uint64(recordSize(*msg)) + msgHeaderWidth
+		if used > 0 && used+width > maxBytes {
+			return msgs, used, true
+		}
+		msgs = append(msgs, msg)
+		used += width
+	}
+	return msgs, used, true
+}
+
+// outOfRange describes a read of offset that found no message. p.segLock must be held.
+func (p *Partition) outOfRange(offset uint64) error {
+	return &OffsetOutOfRangeError{Offset: offset, Start: p.startOffset(), End: p.writableSegment.flushedOffset.Load()}
+}
+
+// OffsetForTime returns the first offset whose message timestamp is at least t.
+func (p *Partition) OffsetForTime(t time.Time) (uint64, error) {
+	p.segLock.RLock()
+	defer p.segLock.RUnlock()
+	ts := t.UnixMilli()
+	if p.tier != nil {
+		if off, err := p.tier.offsetForTime(ts); err != io.EOF {
+			return off, err
+		}
+	}
+	for _, segment := range p.segments {
+		maxTs, err := segment.MaxTimestamp()
+		if err == io.EOF || maxTs < ts { // empty segment or every message is older than t
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return segment.OffsetForTime(ts)
+	}
+	return 0, ErrTimestampNotFound
+}
+
+// segmentIndex returns the index of the last segment starting at or before offset, or -1 when offset
+// precedes the partition's start offset.
+func (p *Partition) segmentIndex(offset uint64) int {
+	return sort.Search(len(p.segments), func(i int) bool {
+		return p.segments[i].cfg.StartOffset > offset
+	}) - 1
+}
+
 func (p *Partition) Name() string {
 	return filepath.Join(p.cfg.Dir, fmt.Sprintf("part_%s", p.topic))
 }
 
+// EnableRecordCache serves reads from cache, which may be shared with other partitions, and adds the messages
+// appended or read to it. Messages read share their Key, Value and Headers with the cache, so they must not be
+// modified. It should be called once, before the partition is shared.
+func (p *Partition) EnableRecordCache(cache *RecordCache) {
+	p.recordCache = &partitionCache{cache: cache, partition: p.topic}
+	p.recordCache.purge(0, math.MaxUint64) // left by an earlier instance of the partition
+	p.writableSegment.recordCache = p.recordCache
+}
+
 func (p *Partition) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		p.background.Wait()
+	})
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.segLock.Lock()
+	defer p.segLock.Unlock()
+	p.recordCache.purge(0, math.MaxUint64)
+	if p.producers != nil && p.writableSegment != nil {
+		if err := p.snapshotProducers(); err != nil {
+			return err
+		}
+	}
 	for _, s := range p.segments {
 		if err := s.Close(); err != nil {
 			return err
 		}
 	}
+	if p.tier != nil {
+		return p.tier.close()
+	}
 	return nil
 }
 
+// Recovery describes what was repaired in the partition's segments when it was opened, summed over them.
+func (p *Partition) Recovery() RecoveryReport {
+	return p.recovery
+}
+
+// StartOffset returns the earliest offset still held by the partition, locally or offloaded.
+func (p *Partition) StartOffset() uint64 {
+	p.segLock.RLock()
+	defer p.segLock.RUnlock()
+	return p.startOffset()
+}
+
+func (p *Partition) startOffset() uint64 {
+	if p.tier != nil {
+		if start, ok := p.tier.startOffset(); ok {
+			return start
+		}
+	}
+	return p.segments[0].cfg.StartOffset
+}
+
+// Size returns the bytes of the message files of the partition's local segments. Offloaded segments are not
+// counted.
+func (p *Partition) Size() uint64 {
+	p.segLock.RLock()
+	defer p.segLock.RUnlock()
+	var size uint64
+	for _, s := range p.segments {
+		size += s.Size()
+	}
+	return size
+}
+
 func (p *Partition) LatestCommitedOff() uint64 {
+	p.segLock.RLock()
+	defer p.segLock.RUnlock()
 	return p.writableSegment.LatestCommittedOff()
 }
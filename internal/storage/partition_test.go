@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"github.com/vandathron/bcaster/internal/cfg"
+	"github.com/vandathron/bcaster/internal/model"
+	"math"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewPartition(t *testing.T) {
@@ -66,16 +70,16 @@ func TestPartition_BasicAppendRead(t *testing.T) {
 
 	partition, err := NewPartition(topic, config)
 	require.NoError(t, err)
-	msgByte := getTestMsgByte(0)
-	require.NoError(t, err)
-	offset, err := partition.Append(msgByte)
+	msg := getTestMsg(0)
+	offset, err := partition.Append(msg)
 	require.NoError(t, err)
 	require.Equal(t, uint64(0), offset)
 	require.Equal(t, uint64(0), partition.writableSegment.cfg.StartOffset)
 	require.Equal(t, 1, len(partition.segments))
-	msg, err := partition.Read(offset)
+	readMsg, err := partition.Read(offset)
 	require.NoError(t, err)
-	require.Equal(t, msgByte, msg)
+	require.Equal(t, msg.Value, readMsg.Value)
+	require.Equal(t, offset, readMsg.Offset)
 	require.NoError(t, partition.Close())
 }
 
@@ -94,9 +98,9 @@ func TestPartition_MultiWritesReads(t *testing.T) {
 	nextOffset := uint64(0)
 
 	for i := 0; i < 200; i++ {
-		msgByte := getTestMsgByte(i + 1)
-		msgSizeByte := uint64(len(msgByte) + 8)
-		offset, err := partition.Append(msgByte)
+		msg := getTestMsg(i + 1)
+		msgSizeByte := uint64(recordSize(msg) + msgHeaderWidth)
+		offset, err := partition.Append(msg)
 		require.NoError(t, err)
 		require.Equal(t, uint64(i), offset)
 		currMsgFileSizeByte += msgSizeByte // msgSizeByte varies
@@ -122,7 +126,7 @@ func TestPartition_MultiWritesReads(t *testing.T) {
 		msg, err := partition.Read(uint64(i))
 		require.NoError(t, err, fmt.Sprintf("offset: %d", i))
 		m := message{}
-		err = json.Unmarshal(msg, &m)
+		err = json.Unmarshal(msg.Value, &m)
 		require.NoError(t, err)
 		require.Equal(t, i+1, m.Id)
 	}
@@ -142,6 +146,13 @@ func getTestMsgByte(id int) []byte {
 	return msgByte
 }
 
+func getTestMsg(id int) model.Msg {
+	return model.Msg{
+		Key:   []byte(fmt.Sprintf("customer_%d", id)),
+		Value: getTestMsgByte(id),
+	}
+}
+
 func getPartitionConfig(dir string) cfg.Partition {
 	return cfg.Partition{
 		Dir: dir,
@@ -151,3 +162,483 @@ func getPartitionConfig(dir string) cfg.Partition {
 		},
 	}
 }
+
+func TestPartition_ReadCorruptRecord(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := getPartitionConfig(dir)
+
+	partition, err := NewPartition("customer_created", config)
+	require.NoError(t, err)
+	_, err = partition.Append(getTestMsg(1))
+	require.NoError(t, err)
+	_, err = partition.Read(0)
+	require.NoError(t, err)
+
+	flipByte(t, partition.writableSegment.msgFile.file.Name(), msgHeaderWidth)
+	_, err = partition.Read(0)
+	require.ErrorIs(t, err, ErrCorruptRecord)
+	require.NoError(t, partition.Close())
+}
+
+func TestPartition_MissingIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topic := "customer_created"
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 1024
+
+	partition, err := NewPartition(topic, config)
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		_, err := partition.Append(getTestMsg(i))
+		require.NoError(t, err)
+	}
+	segmentCnt := len(partition.segments)
+	require.Greater(t, segmentCnt, 2)
+	require.NoError(t, partition.Close())
+
+	// losing the first segment's index must not shift pairing of the remaining files
+	require.NoError(t, os.Remove(formatName(0, partition.Name(), ".index")))
+	partition, err = NewPartition(topic, config)
+	require.NoError(t, err)
+	require.Equal(t, segmentCnt, len(partition.segments))
+	require.True(t, partition.segments[0].Recovery().IndexRebuilt)
+	require.Equal(t, partition.segments[0].Recovery(), partition.Recovery()) // the other segments were not repaired
+	for i := 0; i < 50; i++ {
+		msg, err := partition.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, getTestMsgByte(i), msg.Value)
+	}
+	require.NoError(t, partition.Close())
+
+	// a torn message at the tail is reported alongside a clean open of the other segments
+	last := partition.writableSegment.cfg.StartOffset
+	size := partition.writableSegment.msgFile.CurrentSize()
+	require.NoError(t, os.Truncate(formatName(last, partition.Name(), ".message"), int64(size-5)))
+	partition, err = NewPartition(topic, config)
+	require.NoError(t, err)
+	require.True(t, partition.Recovery().Repaired())
+	require.False(t, partition.Recovery().IndexRebuilt)
+	require.Greater(t, partition.Recovery().TruncatedBytes, uint64(0))
+	require.Equal(t, uint64(1), partition.Recovery().DroppedEntries)
+	require.NoError(t, partition.Close())
+}
+
+func TestPartition_OffsetForTime(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topic := "customer_created"
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 1024
+
+	partition, err := NewPartition(topic, config)
+	require.NoError(t, err)
+	start := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 50; i++ {
+		msg := getTestMsg(i)
+		msg.Timestamp = start.Add(time.Duration(i) * time.Minute)
+		_, err := partition.Append(msg)
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(partition.segments), 2)
+
+	requireOffsets := func() {
+		off, err := partition.OffsetForTime(start.Add(-time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+
+		for i := 0; i < 50; i++ {
+			off, err = partition.OffsetForTime(start.Add(time.Duration(i) * time.Minute))
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), off)
+
+			off, err = partition.OffsetForTime(start.Add(time.Duration(i)*time.Minute - time.Second))
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), off)
+		}
+
+		_, err = partition.OffsetForTime(start.Add(time.Hour))
+		require.ErrorIs(t, err, ErrTimestampNotFound)
+	}
+	requireOffsets()
+	require.NoError(t, partition.Close())
+
+	// time index is rebuilt when lost
+	require.NoError(t, os.Remove(formatName(0, partition.Name(), ".timeindex")))
+	partition, err = NewPartition(topic, config)
+	require.NoError(t, err)
+	require.True(t, partition.segments[0].Recovery().TimeIndexRebuilt)
+	requireOffsets()
+	require.NoError(t, partition.Close())
+}
+
+func TestPartition_AppendBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topic := "customer_created"
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 1024
+
+	partition, err := NewPartition(topic, config)
+	require.NoError(t, err)
+	_, err = partition.Append(getTestMsg(0))
+	require.NoError(t, err)
+
+	batch := make([]model.Msg, 50)
+	for i := range batch {
+		batch[i] = getTestMsg(i + 1)
+	}
+	first, last, err := partition.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(50), last)
+	require.Greater(t, len(partition.segments), 1) // batch rolled over full segments
+
+	_, _, err = partition.AppendBatch(nil)
+	require.ErrorIs(t, err, ErrEmptyBatch)
+	require.NoError(t, partition.Close())
+
+	partition, err = NewPartition(topic, config)
+	require.NoError(t, err)
+	defer partition.Close()
+	require.Equal(t, uint64(50), partition.LatestCommitedOff())
+	for i := 0; i <= 50; i++ {
+		msg, err := partition.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), msg.Offset)
+		require.Equal(t, getTestMsgByte(i), msg.Value)
+	}
+}
+
+func TestPartition_MessageTooLarge(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 64
+
+	partition, err := NewPartition("customer_created", config)
+	require.NoError(t, err)
+	defer partition.Close()
+	_, err = partition.Append(getTestMsg(0))
+	require.ErrorIs(t, err, ErrMessageTooLarge)
+	_, _, err = partition.AppendBatch([]model.Msg{getTestMsg(0)})
+	require.ErrorIs(t, err, ErrMessageTooLarge)
+	require.Equal(t, 1, len(partition.segments))
+}
+
+func TestPartition_BatchWithTooLargeMessage(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 256
+
+	partition, err := NewPartition("customer_created", config)
+	require.NoError(t, err)
+	defer partition.Close()
+	_, err = partition.Append(getTestMsg(0))
+	require.NoError(t, err)
+
+	// nothing is written and no segment is rolled when a message of the batch cannot fit any segment
+	large := getTestMsg(3)
+	large.Value = make([]byte, 256)
+	_, _, err = partition.AppendBatch([]model.Msg{getTestMsg(1), getTestMsg(2), large})
+	require.ErrorIs(t, err, ErrMessageTooLarge)
+	require.Equal(t, uint64(1), partition.HighWatermark())
+	require.Equal(t, 1, len(partition.segments))
+	_, err = partition.Append(large)
+	require.ErrorIs(t, err, ErrMessageTooLarge)
+	require.Equal(t, 1, len(partition.segments))
+}
+
+func TestPartition_FullIndexReopen(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := getPartitionConfig(dir)
+	config.MaxIdxSizeByte = 3 * indexEntryWidth // every message is indexed, so segments fill their index first
+
+	partition, err := NewPartition("customer_created", config)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		off, err := partition.Append(getTestMsg(i))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	require.Equal(t, 2, len(partition.segments))
+	require.NoError(t, partition.Close())
+
+	// a message rejected by a full index is not left in the message file of the segment it did not fit
+	partition, err = NewPartition("customer_created", config)
+	require.NoError(t, err)
+	defer partition.Close()
+	require.Equal(t, uint64(5), partition.HighWatermark())
+	for i := 0; i < 5; i++ {
+		msg, err := partition.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), msg.Offset)
+		require.Equal(t, getTestMsgByte(i), msg.Value)
+	}
+}
+
+func TestPartition_ReadRange(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 1024
+	config.IdxIntervalByte = 200
+
+	partition, err := NewPartition("customer_created", config)
+	require.NoError(t, err)
+	defer partition.Close()
+	var width int
+	for i := 0; i < 50; i++ {
+		msg := getTestMsg(i)
+		width = int(recordSize(msg)) + msgHeaderWidth // every test message encodes to the same size
+		_, err := partition.Append(msg)
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(partition.segments), 2)
+
+	// spans segments and stops at the message count
+	msgs, err := partition.ReadRange(3, 30, 1024*1024)
+	require.NoError(t, err)
+	require.Equal(t, 30, len(msgs))
+	for i, msg := range msgs {
+		require.Equal(t, uint64(3+i), msg.Offset)
+		require.Equal(t, getTestMsgByte(3+i), msg.Value)
+	}
+
+	// stops at the byte budget
+	msgs, err = partition.ReadRange(10, 30, width*4+width/2)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(msgs))
+	require.Equal(t, uint64(13), msgs[3].Offset)
+
+	// a budget smaller than one message still returns it
+	msgs, err = partition.ReadRange(10, 30, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, uint64(10), msgs[0].Offset)
+
+	// reads up to the end of the partition
+	msgs, err = partition.ReadRange(45, 30, 1024*1024)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(msgs))
+
+	_, err = partition.ReadRange(50, 30, 1024*1024)
+	var rangeErr *OffsetOutOfRangeError
+	require.ErrorAs(t, err, &rangeErr)
+	require.Equal(t, OffsetOutOfRangeError{Offset: 50, Start: 0, End: 50}, *rangeErr)
+}
+
+func TestPartition_ReadRangeChunks(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	partition, err := NewPartition("customer_created", getPartitionConfig(dir))
+	require.NoError(t, err)
+	defer partition.Close()
+	var msgs []model.Msg
+	for i := 0; i < 1500; i++ {
+		msgs = append(msgs, getTestMsg(i))
+	}
+	_, _, err = partition.AppendBatch(msgs)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(partition.segments))
+	require.Greater(t, partition.Size(), uint64(readRangeChunkByte))
+
+	read, err := partition.ReadRange(0, 1, math.MaxInt)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(read))
+
+	// a segment larger than a single read is read in chunks
+	read, err = partition.ReadRange(0, 2000, math.MaxInt)
+	require.NoError(t, err)
+	require.Equal(t, 1500, len(read))
+	for i, msg := range read {
+		require.Equal(t, uint64(i), msg.Offset)
+		require.Equal(t, getTestMsgByte(i), msg.Value)
+	}
+}
+
+func TestPartition_ConcurrentAppendRead(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 2048 // small segments so writers roll while readers iterate
+
+	partition, err := NewPartition("customer_created", config)
+	require.NoError(t, err)
+	defer partition.Close()
+
+	const writers, perWriter = 4, 100
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				if i%10 == 0 {
+					batch := []model.Msg{getTestMsg(w), getTestMsg(w)}
+					_, _, err := partition.AppendBatch(batch)
+					require.NoError(t, err)
+					continue
+				}
+				_, err := partition.Append(getTestMsg(w))
+				require.NoError(t, err)
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				latest := partition.LatestCommitedOff()
+				if latest == math.MaxUint64 { // nothing appended yet
+					continue
+				}
+				msg, err := partition.Read(latest)
+				require.NoError(t, err)
+				require.Equal(t, latest, msg.Offset)
+
+				msgs, err := partition.ReadRange(partition.StartOffset(), 50, 4096)
+				require.NoError(t, err)
+				for i := 1; i < len(msgs); i++ {
+					require.Equal(t, msgs[i-1].Offset+1, msgs[i].Offset)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	total := uint64(writers * (perWriter + perWriter/10))
+	require.Equal(t, total-1, partition.LatestCommitedOff())
+	msgs, err := partition.ReadRange(0, int(total), math.MaxInt)
+	require.NoError(t, err)
+	require.Equal(t, int(total), len(msgs))
+}
+
+func TestPartition_TimeBasedRoll(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topic := "customer_created"
+	config := getPartitionConfig(dir)
+	config.MaxAge = time.Hour
+	config.MaxIdle = time.Minute
+
+	partition, err := NewPartition(topic, config)
+	require.NoError(t, err)
+	_, err = partition.Append(getTestMsg(0))
+	require.NoError(t, err)
+	_, err = partition.Append(getTestMsg(1))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(partition.segments))
+
+	partition.writableSegment.lastAppend = time.Now().Add(-2 * time.Minute) // idle for longer than MaxIdle
+	_, err = partition.Append(getTestMsg(2))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(partition.segments))
+	require.Equal(t, uint64(2), partition.writableSegment.cfg.StartOffset)
+
+	partition.writableSegment.meta.CreatedAt = time.Now().Add(-2 * time.Hour) // open for longer than MaxAge
+	_, _, err = partition.AppendBatch([]model.Msg{getTestMsg(3), getTestMsg(4)})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(partition.segments))
+	require.Equal(t, uint64(3), partition.writableSegment.cfg.StartOffset)
+	createdAt := partition.writableSegment.meta.CreatedAt
+	require.NoError(t, partition.Close())
+
+	partition, err = NewPartition(topic, config)
+	require.NoError(t, err)
+	defer partition.Close()
+	require.Equal(t, createdAt.UnixMilli(), partition.writableSegment.meta.CreatedAt.UnixMilli())
+	_, err = partition.Append(getTestMsg(5)) // neither limit is exceeded after a restart
+	require.NoError(t, err)
+	require.Equal(t, 3, len(partition.segments))
+}
+
+func TestPartition_TruncateTo(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topic := "customer_created"
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 1024
+	config.IdxIntervalByte = 200
+
+	partition, err := NewPartition(topic, config)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := partition.Append(getTestMsg(i))
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(partition.segments), 3)
+
+	require.NoError(t, partition.TruncateTo(37))
+	require.Equal(t, uint64(36), partition.LatestCommitedOff())
+	require.Equal(t, partition.writableSegment, partition.segments[len(partition.segments)-1])
+	require.Less(t, partition.writableSegment.cfg.StartOffset, uint64(37))
+	_, err = partition.Read(37)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	require.NoError(t, partition.TruncateTo(50)) // nothing past the end to remove
+
+	off, err := partition.Append(getTestMsg(100))
+	require.NoError(t, err)
+	require.Equal(t, uint64(37), off)
+	require.NoError(t, partition.Close())
+
+	partition, err = NewPartition(topic, config)
+	require.NoError(t, err)
+	require.False(t, partition.writableSegment.Recovery().Repaired())
+	require.Equal(t, uint64(37), partition.LatestCommitedOff())
+	for i := 0; i < 37; i++ {
+		msg, err := partition.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, getTestMsgByte(i), msg.Value)
+	}
+	msg, err := partition.Read(37)
+	require.NoError(t, err)
+	require.Equal(t, getTestMsgByte(100), msg.Value)
+
+	// truncating to a segment's base offset deletes the whole segment
+	segmentCnt := len(partition.segments)
+	base := partition.writableSegment.cfg.StartOffset
+	require.NoError(t, partition.TruncateTo(base))
+	require.Equal(t, segmentCnt-1, len(partition.segments))
+	require.Less(t, partition.writableSegment.cfg.StartOffset, base)
+	require.Equal(t, base-1, partition.LatestCommitedOff())
+	_, err = os.Stat(formatName(base, partition.Name(), ".message"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, partition.TruncateTo(0))
+	require.Equal(t, 1, len(partition.segments))
+	_, err = partition.Read(0)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	off, err = partition.Append(getTestMsg(0))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.NoError(t, partition.Close())
+}
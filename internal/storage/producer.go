@@ -0,0 +1,361 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/vandathron/bcaster/internal/model"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	producerSnapshotFile      = "producers.snapshot"
+	producerSnapshotVersionV1 = byte(1)
+	producerSnapshotVersionV2 = byte(2) // adds open and aborted transactions
+	maxProducerRanges         = 5       // appended sequence ranges remembered per producer to detect retries
+	producerRangeWidth        = 2*sequenceWidth + 2*recOffsetWidth
+	producerEntryHeaderWidth  = producerIDWidth + epochWidth + 1
+	abortedTxnWidth           = producerIDWidth + 2*recOffsetWidth
+	noOpenTxn                 = math.MaxUint64
+)
+
+// sequenceRange is a run of consecutive sequence numbers a producer appended at consecutive offsets.
+type sequenceRange struct {
+	firstSeq    int32
+	lastSeq     int32
+	firstOffset uint64
+	lastOffset  uint64
+}
+
+type producerEntry struct {
+	epoch  uint16
+	ranges []sequenceRange // oldest first
+	inTxn  bool
+	txnOff uint64 // offset of the first message of the open transaction
+}
+
+// abortedTxn spans the messages of an aborted transaction, from its first message to its abort marker.
+type abortedTxn struct {
+	firstOffset uint64
+	lastOffset  uint64
+}
+
+// producerStates tracks the sequence numbers each idempotent producer appended to a partition, and the
+// transactions they opened and aborted.
+type producerStates struct {
+	producers map[uint64]*producerEntry
+	aborted   map[uint64][]abortedTxn // by producer, in the order they were aborted
+}
+
+func newProducerStates() *producerStates {
+	return &producerStates{producers: make(map[uint64]*producerEntry), aborted: make(map[uint64][]abortedTxn)}
+}
+
+// check validates a batch of n messages starting at producer.Sequence. A batch that was already appended is
+// returned as a range holding its offsets.
+func (s *producerStates) check(producer model.Producer, n int) (*sequenceRange, error) {
+	if producer.ID == 0 {
+		return nil, errors.New("producer id should be positive")
+	}
+	if producer.Sequence < 0 {
+		return nil, fmt.Errorf("sequence should not be negative: %d", producer.Sequence)
+	}
+	lastSeq := producer.Sequence + int32(n) - 1
+
+	e, ok := s.producers[producer.ID]
+	if !ok || producer.Epoch > e.epoch {
+		if producer.Sequence != 0 {
+			return nil, fmt.Errorf("%w: producer %d epoch %d should start at 0, got %d", ErrOutOfOrderSequence,
+				producer.ID, producer.Epoch, producer.Sequence)
+		}
+		return nil, nil
+	}
+	if producer.Epoch < e.epoch {
+		return nil, fmt.Errorf("%w: producer %d epoch %d, current epoch %d", ErrProducerFenced, producer.ID,
+			producer.Epoch, e.epoch)
+	}
+
+	last := e.ranges[len(e.ranges)-1]
+	if producer.Sequence == last.lastSeq+1 {
+		return nil, nil
+	}
+	if producer.Sequence > last.lastSeq+1 {
+		return nil, fmt.Errorf("%w: producer %d expected %d, got %d", ErrOutOfOrderSequence, producer.ID,
+			last.lastSeq+1, producer.Sequence)
+	}
+	for _, r := range e.ranges {
+		if producer.Sequence >= r.firstSeq && lastSeq <= r.lastSeq {
+			return &sequenceRange{
+				firstSeq:    producer.Sequence,
+				lastSeq:     lastSeq,
+				firstOffset: r.firstOffset + uint64(producer.Sequence-r.firstSeq),
+				lastOffset:  r.firstOffset + uint64(lastSeq-r.firstSeq),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: producer %d sequences %d to %d", ErrDuplicateSequence, producer.ID,
+		producer.Sequence, lastSeq)
+}
+
+// checkMarker validates a marker ending producer's transaction, reporting false when the producer has no
+// open transaction to end.
+func (s *producerStates) checkMarker(producer model.Producer, control model.Control) (bool, error) {
+	if producer.ID == 0 {
+		return false, errors.New("producer id should be positive")
+	}
+	if control != model.ControlCommit && control != model.ControlAbort {
+		return false, fmt.Errorf("invalid transaction marker: %d", control)
+	}
+	e, ok := s.producers[producer.ID]
+	if !ok {
+		return false, nil
+	}
+	if producer.Epoch < e.epoch {
+		return false, fmt.Errorf("%w: producer %d epoch %d, current epoch %d", ErrProducerFenced, producer.ID,
+			producer.Epoch, e.epoch)
+	}
+	return e.inTxn, nil
+}
+
+// update records that msg, written by an idempotent producer, was appended at msg.Offset.
+func (s *producerStates) update(msg model.Msg) {
+	producer, offset := msg.Producer, msg.Offset
+	e, ok := s.producers[producer.ID]
+	if msg.Control != model.ControlNone {
+		if ok && e.inTxn {
+			if msg.Control == model.ControlAbort {
+				s.aborted[producer.ID] = append(s.aborted[producer.ID], abortedTxn{firstOffset: e.txnOff, lastOffset: offset})
+			}
+			e.inTxn = false
+		}
+		return // markers do not take a sequence number
+	}
+	if !ok || producer.Epoch > e.epoch {
+		next := &producerEntry{epoch: producer.Epoch}
+		if ok { // a transaction stays open until a marker ends it
+			next.inTxn, next.txnOff = e.inTxn, e.txnOff
+		}
+		e = next
+		s.producers[producer.ID] = e
+	}
+	if msg.Transactional && !e.inTxn {
+		e.inTxn, e.txnOff = true, offset
+	}
+	if n := len(e.ranges); n > 0 {
+		last := &e.ranges[n-1]
+		if producer.Sequence == last.lastSeq+1 && offset == last.lastOffset+1 {
+			last.lastSeq, last.lastOffset = producer.Sequence, offset
+			return
+		}
+	}
+	e.ranges = append(e.ranges, sequenceRange{
+		firstSeq:    producer.Sequence,
+		lastSeq:     producer.Sequence,
+		firstOffset: offset,
+		lastOffset:  offset,
+	})
+	if len(e.ranges) > maxProducerRanges {
+		e.ranges = e.ranges[1:]
+	}
+}
+
+// firstOpenOffset returns the offset of the first message of the oldest open transaction, or end when no
+// transaction is open.
+func (s *producerStates) firstOpenOffset(end uint64) uint64 {
+	for _, e := range s.producers {
+		if e.inTxn {
+			end = min(end, e.txnOff)
+		}
+	}
+	return end
+}
+
+// isAborted reports whether msg belongs to an aborted transaction.
+func (s *producerStates) isAborted(msg *model.Msg) bool {
+	if !msg.Transactional {
+		return false
+	}
+	aborted := s.aborted[msg.Producer.ID] // a producer's transactions do not overlap, so both offsets increase
+	i := sort.Search(len(aborted), func(i int) bool { return aborted[i].lastOffset >= msg.Offset })
+	return i < len(aborted) && aborted[i].firstOffset <= msg.Offset
+}
+
+// prune forgets the aborted transactions that ended before offset, whose messages are no longer held.
+func (s *producerStates) prune(offset uint64) {
+	for id, aborted := range s.aborted {
+		i := sort.Search(len(aborted), func(i int) bool { return aborted[i].lastOffset >= offset })
+		if i == len(aborted) {
+			delete(s.aborted, id)
+		} else {
+			s.aborted[id] = aborted[i:] // not changed in place, a copy made by Compact may share it
+		}
+	}
+}
+
+// loadProducers rebuilds the producer states from the snapshot and the messages appended after it. A
+// snapshot taken past the end of the log, which was truncated since, is ignored.
+func (p *Partition) loadProducers() error {
+	producers := newProducerStates()
+	end := p.writableSegment.nextOffset
+	from := p.segments[0].cfg.StartOffset
+	states, snapshotOff, err := readProducerSnapshot(filepath.Join(p.Name(), producerSnapshotFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil && snapshotOff <= end {
+		producers = states
+		from = max(from, snapshotOff)
+	}
+
+	for i := p.segmentIndex(from); i >= 0 && i < len(p.segments); i++ {
+		for off := max(from, p.segments[i].cfg.StartOffset); ; {
+			msgs, _, err := p.segments[i].readRange(off, 1024, 1024*1024, 0)
+			for _, msg := range msgs {
+				if msg.Producer.ID != 0 {
+					producers.update(*msg)
+				}
+				off = msg.Offset + 1
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	p.producersLock.Lock()
+	p.producers = producers
+	p.producersLock.Unlock()
+	return nil
+}
+
+// snapshotProducers persists the producer states as of the end of the log, so loading them only replays
+// the messages appended afterwards. p.lock must be held.
+func (p *Partition) snapshotProducers() error {
+	return writeProducerSnapshot(filepath.Join(p.Name(), producerSnapshotFile), p.producers, p.writableSegment.nextOffset)
+}
+
+// Snapshot layout (v2), all integers big endian:
+//
+//	version (1) | offset (8) | producer count (4) |
+//	[producer id (8) | epoch (2) | range count (1) | [first seq (4) | last seq (4) | first offset (8) | last offset (8)]... |
+//	open transaction offset (8)]... | aborted count (4) | [producer id (8) | first offset (8) | last offset (8)]...
+//
+// The open transaction offset is math.MaxUint64 for a producer without one. v1 snapshots end after the last
+// range of each producer and have no aborted transactions.
+func writeProducerSnapshot(name string, s *producerStates, offset uint64) error {
+	ids := make([]uint64, 0, len(s.producers))
+	for id := range s.producers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	b := []byte{producerSnapshotVersionV2}
+	b = binary.BigEndian.AppendUint64(b, offset)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(ids)))
+	for _, id := range ids {
+		e := s.producers[id]
+		b = binary.BigEndian.AppendUint64(b, id)
+		b = binary.BigEndian.AppendUint16(b, e.epoch)
+		b = append(b, byte(len(e.ranges)))
+		for _, r := range e.ranges {
+			b = binary.BigEndian.AppendUint32(b, uint32(r.firstSeq))
+			b = binary.BigEndian.AppendUint32(b, uint32(r.lastSeq))
+			b = binary.BigEndian.AppendUint64(b, r.firstOffset)
+			b = binary.BigEndian.AppendUint64(b, r.lastOffset)
+		}
+		txnOff := uint64(noOpenTxn)
+		if e.inTxn {
+			txnOff = e.txnOff
+		}
+		b = binary.BigEndian.AppendUint64(b, txnOff)
+	}
+	ids = ids[:0]
+	abortedCnt := 0
+	for id, aborted := range s.aborted {
+		ids = append(ids, id)
+		abortedCnt += len(aborted)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	b = binary.BigEndian.AppendUint32(b, uint32(abortedCnt))
+	for _, id := range ids {
+		for _, t := range s.aborted[id] {
+			b = binary.BigEndian.AppendUint64(b, id)
+			b = binary.BigEndian.AppendUint64(b, t.firstOffset)
+			b = binary.BigEndian.AppendUint64(b, t.lastOffset)
+		}
+	}
+	return writeFileAtomic(name, b)
+}
+
+func readProducerSnapshot(name string) (*producerStates, uint64, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	invalid := fmt.Errorf("invalid producer snapshot file: %s", name)
+	if len(b) < metaVersionWidth+recOffsetWidth+4 || (b[0] != producerSnapshotVersionV1 && b[0] != producerSnapshotVersionV2) {
+		return nil, 0, invalid
+	}
+	version := b[0]
+	offset := binary.BigEndian.Uint64(b[metaVersionWidth:])
+	count := binary.BigEndian.Uint32(b[metaVersionWidth+recOffsetWidth:])
+	b = b[metaVersionWidth+recOffsetWidth+4:]
+
+	s := newProducerStates()
+	for i := uint32(0); i < count; i++ {
+		if len(b) < producerEntryHeaderWidth {
+			return nil, 0, invalid
+		}
+		id := binary.BigEndian.Uint64(b)
+		e := &producerEntry{epoch: binary.BigEndian.Uint16(b[producerIDWidth:])}
+		rangeCnt := int(b[producerIDWidth+epochWidth])
+		b = b[producerEntryHeaderWidth:]
+		if len(b) < rangeCnt*producerRangeWidth || rangeCnt == 0 {
+			return nil, 0, invalid
+		}
+		for j := 0; j < rangeCnt; j++ {
+			e.ranges = append(e.ranges, sequenceRange{
+				firstSeq:    int32(binary.BigEndian.Uint32(b)),
+				lastSeq:     int32(binary.BigEndian.Uint32(b[sequenceWidth:])),
+				firstOffset: binary.BigEndian.Uint64(b[2*sequenceWidth:]),
+				lastOffset:  binary.BigEndian.Uint64(b[2*sequenceWidth+recOffsetWidth:]),
+			})
+			b = b[producerRangeWidth:]
+		}
+		if version == producerSnapshotVersionV2 {
+			if len(b) < recOffsetWidth {
+				return nil, 0, invalid
+			}
+			if txnOff := binary.BigEndian.Uint64(b); txnOff != noOpenTxn {
+				e.inTxn, e.txnOff = true, txnOff
+			}
+			b = b[recOffsetWidth:]
+		}
+		s.producers[id] = e
+	}
+
+	if version == producerSnapshotVersionV2 {
+		if len(b) < 4 {
+			return nil, 0, invalid
+		}
+		count = binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if uint64(len(b)) != uint64(count)*abortedTxnWidth {
+			return nil, 0, invalid
+		}
+		for ; len(b) > 0; b = b[abortedTxnWidth:] {
+			id := binary.BigEndian.Uint64(b)
+			s.aborted[id] = append(s.aborted[id], abortedTxn{
+				firstOffset: binary.BigEndian.Uint64(b[producerIDWidth:]),
+				lastOffset:  binary.BigEndian.Uint64(b[producerIDWidth+recOffsetWidth:]),
+			})
+		}
+	}
+	return s, offset, nil
+}
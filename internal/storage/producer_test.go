@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/vandathron/bcaster/internal/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartition_AppendIdempotent(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topic := "customer_created"
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 1024
+
+	partition, err := NewPartition(topic, config)
+	require.NoError(t, err)
+	producer := model.Producer{ID: 1}
+	batch := func(from, n int) []model.Msg {
+		var msgs []model.Msg
+		for i := from; i < from+n; i++ {
+			msgs = append(msgs, getTestMsg(i))
+		}
+		return msgs
+	}
+
+	first, last, err := partition.AppendIdempotent(producer, batch(0, 3))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 2}, []uint64{first, last})
+	_, err = partition.Append(getTestMsg(100)) // plain appends interleave with the producer's
+	require.NoError(t, err)
+
+	// a retried batch is not appended again
+	first, last, err = partition.AppendIdempotent(producer, batch(0, 3))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 2}, []uint64{first, last})
+	require.Equal(t, uint64(4), partition.HighWatermark())
+	msg, err := partition.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, model.Producer{ID: 1, Sequence: 1}, msg.Producer)
+
+	producer.Sequence = 5
+	_, _, err = partition.AppendIdempotent(producer, batch(5, 1))
+	require.ErrorIs(t, err, ErrOutOfOrderSequence)
+	for i := 3; i < 30; i++ { // rolls segments, which snapshots the producers
+		producer.Sequence = int32(i)
+		first, last, err = partition.AppendIdempotent(producer, batch(i, 1))
+		require.NoError(t, err)
+		require.Equal(t, first, last)
+		require.Equal(t, uint64(i+1), first)
+	}
+	require.Greater(t, len(partition.segments), 1)
+	require.NoError(t, partition.Close())
+
+	// sequences survive a restart, with and without a snapshot to start from
+	for _, removeSnapshot := range []bool{false, true} {
+		if removeSnapshot {
+			require.NoError(t, os.Remove(filepath.Join(partition.Name(), producerSnapshotFile)))
+		}
+		partition, err = NewPartition(topic, config)
+		require.NoError(t, err)
+		producer.Sequence = 29
+		first, _, err = partition.AppendIdempotent(producer, batch(29, 1))
+		require.NoError(t, err)
+		require.Equal(t, uint64(30), first)
+		require.Equal(t, uint64(31), partition.HighWatermark())
+		require.NoError(t, partition.Close())
+	}
+
+	partition, err = NewPartition(topic, config)
+	require.NoError(t, err)
+	defer partition.Close()
+
+	// a new epoch starts over and fences the previous one
+	_, _, err = partition.AppendIdempotent(model.Producer{ID: 1, Epoch: 1, Sequence: 3}, batch(0, 1))
+	require.ErrorIs(t, err, ErrOutOfOrderSequence)
+	first, _, err = partition.AppendIdempotent(model.Producer{ID: 1, Epoch: 1}, batch(0, 1))
+	require.NoError(t, err)
+	require.Equal(t, uint64(31), first)
+	producer.Sequence = 30
+	_, _, err = partition.AppendIdempotent(producer, batch(30, 1))
+	require.ErrorIs(t, err, ErrProducerFenced)
+
+	// truncating away epoch 1 makes epoch 0 current again
+	require.NoError(t, partition.TruncateTo(31))
+	first, _, err = partition.AppendIdempotent(producer, batch(30, 1))
+	require.NoError(t, err)
+	require.Equal(t, uint64(31), first)
+}
+
+func TestProducerStates_DuplicateWindow(t *testing.T) {
+	s := newProducerStates()
+	producer := model.Producer{ID: 1}
+	for i := 0; i < 2*maxProducerRanges; i++ { // a gap in offsets starts a new range
+		producer.Sequence = int32(i)
+		s.update(model.Msg{Offset: uint64(2 * i), Producer: producer})
+	}
+	require.Equal(t, maxProducerRanges, len(s.producers[1].ranges))
+
+	producer.Sequence = int32(2*maxProducerRanges - 1)
+	dup, err := s.check(producer, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4*maxProducerRanges-2), dup.firstOffset)
+
+	producer.Sequence = 0 // too old to know where it was appended
+	_, err = s.check(producer, 1)
+	require.ErrorIs(t, err, ErrDuplicateSequence)
+
+	snapshot := filepath.Join(t.TempDir(), producerSnapshotFile)
+	require.NoError(t, writeProducerSnapshot(snapshot, s, 42))
+	loaded, offset, err := readProducerSnapshot(snapshot)
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), offset)
+	require.Equal(t, s, loaded)
+}
+
+func TestPartition_AppendIdempotentPartialBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topic := "customer_created"
+	config := getPartitionConfig(dir)
+	msg := getTestMsg(0)
+	msg.Producer.ID = 1
+	config.MaxMsgSizeByte = 2 * (uint64(recordSize(msg)) + msgHeaderWidth) // two messages per segment
+
+	partition, err := NewPartition(topic, config)
+	require.NoError(t, err)
+	defer partition.Close()
+	producer := model.Producer{ID: 1}
+	batch := []model.Msg{getTestMsg(0), getTestMsg(1), getTestMsg(2)}
+
+	large := getTestMsg(3)
+	large.Value = make([]byte, config.MaxMsgSizeByte)
+	_, _, err = partition.AppendIdempotent(producer, append(batch[:2:2], large))
+	require.ErrorIs(t, err, ErrMessageTooLarge)
+	require.Equal(t, uint64(0), partition.HighWatermark())
+
+	// the segment the batch rolls to cannot be created, after the first two messages were written
+	require.NoError(t, os.Mkdir(filepath.Join(partition.Name(), "2.index"), 0750))
+	_, _, err = partition.AppendIdempotent(producer, batch)
+	require.Error(t, err)
+	require.Equal(t, uint64(2), partition.HighWatermark())
+
+	// a retry does not write the messages that made it again
+	_, _, err = partition.AppendIdempotent(producer, batch)
+	require.ErrorIs(t, err, ErrDuplicateSequence)
+	require.NoError(t, os.Remove(filepath.Join(partition.Name(), "2.index")))
+	producer.Sequence = 2
+	first, last, err := partition.AppendIdempotent(producer, batch[2:])
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 2}, []uint64{first, last})
+}
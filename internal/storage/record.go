@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"github.com/vandathron/bcaster/internal/model"
+	"math"
+	"time"
+)
+
+// Record layout (v1), all integers big endian:
+//
+//	magic (1) | attributes (1) | offset (8) | timestamp ms (8) | key len (4) | key |
+//	header count (4) | [header key len (2) | header key | header value len (4) | header value]... |
+//	value len (4) | value
+//
+// A length of -1 encodes a nil key, header value or value. Bit 0 of the attributes marks a transactional
+// message and bits 1-2 hold the model.Control of a transaction marker. Bit 3 marks an encrypted record, whose
+// bytes after the offset are replaced by nonce (12) | ciphertext | tag (16), authenticating the header too.
+//
+// Record layout (v2) is written for messages of idempotent producers. It inserts the producer after the
+// timestamp:
+//
+//	... | timestamp ms (8) | producer id (8) | producer epoch (2) | sequence (4) | key len (4) | ...
+const (
+	recordMagicV1 byte = 1
+	recordMagicV2 byte = 2
+
+	magicWidth        = 1
+	attributesWidth   = 1
+	recOffsetWidth    = 8
+	timestampWidth    = 8
+	bytesLenWidth     = 4
+	headerCntWidth    = 4
+	headerKeyLenWidth = 2
+	producerIDWidth   = 8
+	epochWidth        = 2
+	sequenceWidth     = 4
+	producerWidth     = producerIDWidth + epochWidth + sequenceWidth
+
+	recordHeaderWidth = magicWidth + attributesWidth + recOffsetWidth
+
+	recordOverhead = magicWidth + attributesWidth + recOffsetWidth + timestampWidth + bytesLenWidth + headerCntWidth + bytesLenWidth
+	nilLen         = math.MaxUint32 // -1 as uint32
+
+	attrTransactional = 1 << 0
+	attrControlShift  = 1
+	attrControlMask   = 3 << attrControlShift
+	attrEncrypted     = 1 << 3
+
+	encryptionOverhead = 12 + 16 // GCM nonce and tag added by encryptRecord
+)
+
+// recordSize returns the encoded size of msg, excluding the message file's length and checksum prefix.
+func recordSize(msg model.Msg) int {
+	size := recordOverhead + len(msg.Key) + len(msg.Value)
+	if msg.Producer.ID != 0 {
+		size += producerWidth
+	}
+	for _, h := range msg.Headers {
+		size += headerKeyLenWidth + len(h.Key) + bytesLenWidth + len(h.Value)
+	}
+	return size
+}
+
+// checkEncodable returns the error encodeRecord would fail to encode msg with.
+func checkEncodable(msg model.Msg) error {
+	for _, h := range msg.Headers {
+		if len(h.Key) > math.MaxUint16 {
+			return fmt.Errorf("header key of size %v exceeds max size of %v", len(h.Key), math.MaxUint16)
+		}
+	}
+	return nil
+}
+
+func encodeRecord(offset uint64, msg model.Msg) ([]byte, error) {
+	if err := checkEncodable(msg); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, recordSize(msg))
+	magic := recordMagicV1
+	if msg.Producer.ID != 0 {
+		magic = recordMagicV2
+	}
+	buf = append(buf, magic, recordAttributes(msg))
+	buf = binary.BigEndian.AppendUint64(buf, offset)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(msg.Timestamp.UnixMilli()))
+	if magic == recordMagicV2 {
+		buf = binary.BigEndian.AppendUint64(buf, msg.Producer.ID)
+		buf = binary.BigEndian.AppendUint16(buf, msg.Producer.Epoch)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(msg.Producer.Sequence))
+	}
+	buf = appendBytes(buf, msg.Key)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(msg.Headers)))
+	for _, h := range msg.Headers {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(h.Key)))
+		buf = append(buf, h.Key...)
+		buf = appendBytes(buf, h.Value)
+	}
+	buf = appendBytes(buf, msg.Value)
+	return buf, nil
+}
+
+func recordAttributes(msg model.Msg) byte {
+	attributes := byte(msg.Control) << attrControlShift & attrControlMask
+	if msg.Transactional {
+		attributes |= attrTransactional
+	}
+	return attributes
+}
+
+// decodeRecord parses a record. Validation failures are reported as a *CorruptRecordError without a position.
+func decodeRecord(b []byte) (*model.Msg, error) {
+	d := recordDecoder{buf: b}
+	magic := d.next(magicWidth)
+	if magic == nil {
+		return nil, &CorruptRecordError{Reason: "empty record"}
+	}
+	if magic[0] != recordMagicV1 && magic[0] != recordMagicV2 {
+		return nil, fmt.Errorf("unsupported record version %d", magic[0])
+	}
+
+	msg := &model.Msg{}
+	if attributes := d.next(attributesWidth); attributes != nil {
+		msg.Transactional = attributes[0]&attrTransactional != 0
+		msg.Control = model.Control(attributes[0] & attrControlMask >> attrControlShift)
+	}
+	msg.Offset = d.uint64()
+	msg.Timestamp = time.UnixMilli(int64(d.uint64()))
+	if magic[0] == recordMagicV2 {
+		msg.Producer.ID = d.uint64()
+		if epoch := d.next(epochWidth); epoch != nil {
+			msg.Producer.Epoch = binary.BigEndian.Uint16(epoch)
+		}
+		msg.Producer.Sequence = int32(d.uint32())
+	}
+	msg.Key = d.bytes()
+	headerCnt := d.uint32()
+	for i := uint32(0); i < headerCnt && d.err == nil; i++ {
+		keyLen := d.next(headerKeyLenWidth)
+		if keyLen == nil {
+			break
+		}
+		key := d.next(int(binary.BigEndian.Uint16(keyLen)))
+		msg.Headers = append(msg.Headers, model.Header{Key: string(key), Value: d.bytes()})
+	}
+	msg.Value = d.bytes()
+
+	if d.err == nil && len(d.buf) != 0 {
+		d.err = &CorruptRecordError{Reason: fmt.Sprintf("%d trailing bytes", len(d.buf))}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
+}
+
+// encryptRecord encrypts everything after the header of record, which stays readable so offsets can still
+// be peeked at.
+func encryptRecord(aead cipher.AEAD, record []byte) ([]byte, error) {
+	header := bytes.Clone(record[:recordHeaderWidth])
+	header[magicWidth] |= attrEncrypted
+	sealed, err := encrypt(aead, record[recordHeaderWidth:], header)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, sealed...), nil
+}
+
+// decryptRecord reverses encryptRecord. Records that fail authentication are reported as a
+// *CorruptRecordError without a position.
+func decryptRecord(aead cipher.AEAD, record []byte) ([]byte, error) {
+	if len(record) < recordHeaderWidth {
+		return nil, &CorruptRecordError{Reason: "malformed record"}
+	}
+	plaintext, err := decrypt(aead, record[recordHeaderWidth:], record[:recordHeaderWidth])
+	if err != nil {
+		return nil, &CorruptRecordError{Reason: fmt.Sprintf("decryption failed: %v", err)}
+	}
+	header := bytes.Clone(record[:recordHeaderWidth])
+	header[magicWidth] &^= attrEncrypted
+	return append(header, plaintext...), nil
+}
+
+func recordEncrypted(record []byte) bool {
+	return len(record) > magicWidth && record[magicWidth]&attrEncrypted != 0
+}
+
+// recordOffset peeks at the offset of an encoded record without decoding the rest of it.
+func recordOffset(b []byte) (uint64, error) {
+	start := magicWidth + attributesWidth
+	if len(b) < start+recOffsetWidth {
+		return 0, &CorruptRecordError{Reason: "malformed record"}
+	}
+	return binary.BigEndian.Uint64(b[start : start+recOffsetWidth]), nil
+}
+
+func appendBytes(buf, b []byte) []byte {
+	if b == nil {
+		return binary.BigEndian.AppendUint32(buf, nilLen)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b)))
+	return append(buf, b...)
+}
+
+// recordDecoder consumes a record field by field, remembering the first out-of-bounds read.
+type recordDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *recordDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.buf) {
+		d.err = &CorruptRecordError{Reason: "malformed record"}
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *recordDecoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *recordDecoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *recordDecoder) bytes() []byte {
+	n := d.uint32()
+	if n == nilLen {
+		return nil
+	}
+	return d.next(int(n))
+}
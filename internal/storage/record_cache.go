@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"container/list"
+	"github.com/vandathron/bcaster/internal/model"
+	"sync"
+)
+
+// RecordCache keeps recently appended and read messages of any number of partitions in memory, so consumers
+// reading the same offsets do not each go to disk. The least recently used messages are evicted once the
+// cached records exceed the cache's size.
+type RecordCache struct {
+	lock     sync.Mutex
+	maxBytes uint64
+	bytes    uint64
+	lru      *list.List                          // of *cacheEntry, most recently used first
+	entries  map[string]map[uint64]*list.Element // partition to offset to its element in lru
+	stats    CacheStats
+}
+
+// CacheStats describes the use of a RecordCache. Every message looked up counts as a hit or a miss.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     uint64 // size of the cached records, counted like frames in a message file
+	MaxBytes  uint64
+}
+
+type cacheEntry struct {
+	partition string
+	msg       *model.Msg
+	size      uint64
+}
+
+// NewRecordCache returns an empty cache holding up to maxBytes of records.
+func NewRecordCache(maxBytes uint64) *RecordCache {
+	return &RecordCache{maxBytes: maxBytes, lru: list.New(), entries: make(map[string]map[uint64]*list.Element)}
+}
+
+func (c *RecordCache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := c.stats
+	stats.Entries, stats.Bytes, stats.MaxBytes = c.lru.Len(), c.bytes, c.maxBytes
+	return stats
+}
+
+func (c *RecordCache) get(partition string, offset uint64) (*model.Msg, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[partition][offset]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+	msg := *e.Value.(*cacheEntry).msg // callers own the struct, Key, Value and Headers are shared
+	return &msg, true
+}
+
+func (c *RecordCache) put(partition string, msg *model.Msg) {
+	size := uint64(recordSize(*msg)) + msgHeaderWidth
+	if size > c.maxBytes {
+		return
+	}
+	cached := *msg // later changes to the caller's struct do not leak into the cache
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	offsets, ok := c.entries[partition]
+	if !ok {
+		offsets = make(map[uint64]*list.Element)
+		c.entries[partition] = offsets
+	}
+	if e, ok := offsets[msg.Offset]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	offsets[msg.Offset] = c.lru.PushFront(&cacheEntry{partition: partition, msg: &cached, size: size})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// purge removes the messages of partition at offsets in [from, to).
+func (c *RecordCache) purge(partition string, from, to uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for offset, e := range c.entries[partition] {
+		if offset >= from && offset < to {
+			c.remove(e)
+		}
+	}
+}
+
+// remove drops e from the cache. c.lock must be held.
+func (c *RecordCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	offsets := c.entries[entry.partition]
+	delete(offsets, entry.msg.Offset)
+	if len(offsets) == 0 {
+		delete(c.entries, entry.partition)
+	}
+	c.bytes -= entry.size
+}
+
+// partitionCache is a partition's view of a RecordCache. A nil partitionCache caches nothing.
+type partitionCache struct {
+	cache     *RecordCache
+	partition string
+}
+
+func (c *partitionCache) get(offset uint64) (*model.Msg, bool) {
+	if c == nil {
+		return nil, false
+	}
+	return c.cache.get(c.partition, offset)
+}
+
+func (c *partitionCache) put(msg *model.Msg) {
+	if c != nil {
+		c.cache.put(c.partition, msg)
+	}
+}
+
+// putRecord caches the message of a plaintext record that was just appended.
+func (c *partitionCache) putRecord(record []byte) {
+	if c == nil {
+		return
+	}
+	if msg, err := decodeRecord(record); err == nil {
+		c.cache.put(c.partition, msg)
+	}
+}
+
+func (c *partitionCache) purge(from, to uint64) {
+	if c != nil {
+		c.cache.purge(c.partition, from, to)
+	}
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/vandathron/bcaster/internal/model"
+	"os"
+	"testing"
+)
+
+func TestRecordCache(t *testing.T) {
+	msg := func(off uint64) *model.Msg {
+		m := getTestMsg(int(off))
+		m.Offset = off
+		return &m
+	}
+	width := uint64(recordSize(*msg(0))) + msgHeaderWidth
+	cache := NewRecordCache(3 * width)
+
+	for off := uint64(0); off < 3; off++ {
+		cache.put("orders-0", msg(off))
+	}
+	_, ok := cache.get("orders-0", 0) // 1 becomes the least recently used
+	require.True(t, ok)
+	cache.put("orders-1", msg(0))
+	_, ok = cache.get("orders-0", 1)
+	require.False(t, ok)
+
+	cached, ok := cache.get("orders-1", 0)
+	require.True(t, ok)
+	require.Equal(t, msg(0), cached)
+	cached.Offset = 10 // callers get their own copy
+	cached, _ = cache.get("orders-1", 0)
+	require.Equal(t, uint64(0), cached.Offset)
+
+	cache.purge("orders-0", 0, 1)
+	require.Equal(t, CacheStats{Hits: 3, Misses: 1, Evictions: 1, Entries: 2, Bytes: 2 * width, MaxBytes: 3 * width}, cache.Stats())
+
+	large := msg(3)
+	large.Value = make([]byte, 3*width)
+	cache.put("orders-0", large) // larger than the whole cache
+	require.Equal(t, 2, cache.Stats().Entries)
+}
+
+func TestPartition_RecordCache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cache := NewRecordCache(1024 * 1024)
+
+	partition, err := NewPartition("customer_created", getPartitionConfig(dir))
+	require.NoError(t, err)
+	partition.EnableRecordCache(cache)
+	for i := 0; i < 5; i++ {
+		_, err = partition.Append(getTestMsg(i))
+		require.NoError(t, err)
+	}
+	_, _, err = partition.AppendBatch([]model.Msg{getTestMsg(5), getTestMsg(6)})
+	require.NoError(t, err)
+	require.Equal(t, 7, cache.Stats().Entries) // appends populate the cache
+
+	// cached messages are the ones on disk
+	for off := uint64(0); off < 7; off++ {
+		msg, err := partition.Read(off)
+		require.NoError(t, err)
+		partition.segLock.RLock()
+		stored, err := partition.read(off)
+		partition.segLock.RUnlock()
+		require.NoError(t, err)
+		require.Equal(t, stored, msg)
+	}
+	require.Equal(t, uint64(7), cache.Stats().Hits)
+
+	// a range is served from the cache up to the first missing message, then from disk
+	cache.purge(partition.topic, 2, 4)
+	msgs, err := partition.ReadRange(0, 10, 1024*1024)
+	require.NoError(t, err)
+	require.Equal(t, 7, len(msgs))
+	for i, msg := range msgs {
+		require.Equal(t, uint64(i), msg.Offset)
+		require.Equal(t, getTestMsg(i).Value, msg.Value)
+	}
+	require.Equal(t, 7, cache.Stats().Entries)
+	msgs, err = partition.ReadRange(0, 10, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(msgs))
+
+	// truncated offsets are not served from the cache once appended again
+	require.NoError(t, partition.TruncateTo(5))
+	_, err = partition.Read(5)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	_, err = partition.Append(getTestMsg(10))
+	require.NoError(t, err)
+	msg, err := partition.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, getTestMsg(10).Value, msg.Value)
+
+	require.NoError(t, partition.Close())
+	require.Equal(t, 0, cache.Stats().Entries)
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/vandathron/bcaster/internal/model"
+	"testing"
+	"time"
+)
+
+func TestRecord_EncodeDecode(t *testing.T) {
+	msg := model.Msg{
+		Key:       []byte("customer_1"),
+		Value:     []byte("I love golang!"),
+		Timestamp: time.UnixMilli(1700000000123),
+		Headers: []model.Header{
+			{Key: "trace_id", Value: []byte("abc")},
+			{Key: "empty", Value: []byte{}},
+			{Key: "nil"},
+		},
+	}
+
+	record, err := encodeRecord(42, msg)
+	require.NoError(t, err)
+	require.Equal(t, recordSize(msg), len(record))
+	require.Equal(t, recordMagicV1, record[0])
+
+	decoded, err := decodeRecord(record)
+	require.NoError(t, err)
+	msg.Offset = 42
+	require.Equal(t, msg.Offset, decoded.Offset)
+	require.Equal(t, msg.Key, decoded.Key)
+	require.Equal(t, msg.Value, decoded.Value)
+	require.True(t, msg.Timestamp.Equal(decoded.Timestamp))
+	require.Equal(t, msg.Headers, decoded.Headers)
+}
+
+func TestRecord_Producer(t *testing.T) {
+	msg := model.Msg{
+		Value:     []byte("I love golang!"),
+		Timestamp: time.UnixMilli(1700000000123),
+		Producer:  model.Producer{ID: 7, Epoch: 2, Sequence: 12},
+	}
+
+	record, err := encodeRecord(42, msg)
+	require.NoError(t, err)
+	require.Equal(t, recordSize(msg), len(record))
+	require.Equal(t, recordMagicV2, record[0])
+
+	decoded, err := decodeRecord(record)
+	require.NoError(t, err)
+	require.Equal(t, msg.Producer, decoded.Producer)
+	require.Equal(t, msg.Value, decoded.Value)
+	offset, err := recordOffset(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), offset)
+}
+
+func TestRecord_NilKeyAndValue(t *testing.T) {
+	record, err := encodeRecord(0, model.Msg{Key: []byte{}, Timestamp: time.Now()})
+	require.NoError(t, err)
+
+	decoded, err := decodeRecord(record)
+	require.NoError(t, err)
+	require.NotNil(t, decoded.Key)
+	require.Empty(t, decoded.Key)
+	require.Nil(t, decoded.Value)
+	require.Nil(t, decoded.Headers)
+}
+
+func TestRecord_DecodeInvalid(t *testing.T) {
+	record, err := encodeRecord(1, model.Msg{Value: []byte("I love golang!"), Timestamp: time.Now()})
+	require.NoError(t, err)
+
+	_, err = decodeRecord(record[:len(record)-1])
+	require.ErrorIs(t, err, ErrCorruptRecord)
+
+	_, err = decodeRecord(append(record, 0))
+	require.ErrorIs(t, err, ErrCorruptRecord)
+
+	_, err = decodeRecord(nil)
+	require.ErrorIs(t, err, ErrCorruptRecord)
+
+	record[0] = 99
+	_, err = decodeRecord(record)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrCorruptRecord)
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RemoteStore holds segment files offloaded from local disk. Objects are addressed by slash separated keys
+// and a missing object is reported with an error wrapping os.ErrNotExist.
+type RemoteStore interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	List(prefix string) ([]string, error) // keys starting with prefix, sorted
+	Delete(key string) error              // deleting a missing object is not an error
+}
+
+const remoteTmpExt = ".uploading"
+
+// DirRemoteStore is a RemoteStore backed by a directory, such as a mount of cheap bulk disks.
+type DirRemoteStore struct {
+	dir string
+}
+
+func NewDirRemoteStore(dir string) (*DirRemoteStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &DirRemoteStore{dir: dir}, nil
+}
+
+// Put writes the object to a temporary file first so a partially written object is never visible.
+func (d *DirRemoteStore) Put(key string, r io.Reader) error {
+	name := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0750); err != nil {
+		return err
+	}
+
+	tmp := name + remoteTmpExt
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		return err
+	}
+	return syncPath(filepath.Dir(name))
+}
+
+func (d *DirRemoteStore) Get(key string) (io.ReadCloser, error) {
+	return os.Open(d.path(key))
+}
+
+func (d *DirRemoteStore) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(d.dir, func(name string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || strings.HasSuffix(name, remoteTmpExt) {
+			return err
+		}
+		rel, err := filepath.Rel(d.dir, name)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (d *DirRemoteStore) Delete(key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d *DirRemoteStore) path(key string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(key))
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"io"
+	"time"
+)
+
+// EnforceRetention deletes the oldest segments that exceed the partition's retention policy, offloaded ones
+// included, moving the partition's start offset forward. The writable segment is never deleted.
+func (p *Partition) EnforceRetention() (deleted int, err error) {
+	p.cleanLock.Lock()
+	defer p.cleanLock.Unlock()
+	defer func() {
+		if deleted > 0 {
+			p.pruneAborted(p.StartOffset())
+		}
+	}()
+	p.segLock.Lock()
+	defer p.segLock.Unlock()
+	defer func() {
+		if deleted > 0 {
+			p.recordCache.purge(0, p.startOffset())
+		}
+	}()
+
+	var totalSize uint64
+	for _, s := range p.segments {
+		totalSize += s.Size()
+	}
+	if p.tier != nil {
+		totalSize += p.tier.size()
+	}
+
+	now := time.Now()
+	expired := func(maxTs int64, empty bool) bool {
+		if p.cfg.RetentionByte > 0 && totalSize > p.cfg.RetentionByte {
+			return true
+		}
+		return p.cfg.RetentionAge > 0 && (empty || now.Sub(time.UnixMilli(maxTs)) > p.cfg.RetentionAge)
+	}
+
+	if p.tier != nil { // offloaded segments are the oldest, local ones are only deleted once none are left
+		for {
+			oldest, ok := p.tier.oldest()
+			if !ok {
+				break
+			}
+			if !expired(oldest.maxTimestamp, oldest.maxTimestamp == noMessageTimestamp) {
+				return deleted, nil
+			}
+			totalSize -= oldest.size
+			if err = p.tier.removeOldest(); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+
+	for len(p.segments) > 1 && p.segments[0] != p.writableSegment {
+		oldest := p.segments[0]
+		maxTs, err := oldest.MaxTimestamp()
+		if err != nil && err != io.EOF {
+			return deleted, err
+		}
+		if !expired(maxTs, err == io.EOF) {
+			break
+		}
+
+		totalSize -= oldest.Size()
+		if err = oldest.Remove(); err != nil {
+			return deleted, err
+		}
+		p.segments = p.segments[1:]
+		deleted++
+	}
+	return deleted, nil
+}
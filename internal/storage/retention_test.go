@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPartition_RetentionBySize(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topic := "customer_created"
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 1024
+	config.RetentionByte = 1024 * 2
+
+	partition, err := NewPartition(topic, config)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := partition.Append(getTestMsg(i))
+		require.NoError(t, err)
+	}
+	segmentCnt := len(partition.segments)
+	require.Greater(t, segmentCnt, 3)
+
+	deleted, err := partition.EnforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, segmentCnt-deleted, len(partition.segments))
+	require.Greater(t, deleted, 0)
+
+	var totalSize uint64
+	for _, s := range partition.segments {
+		totalSize += s.Size()
+	}
+	require.LessOrEqual(t, totalSize, config.RetentionByte)
+
+	startOff := partition.StartOffset()
+	require.Equal(t, partition.segments[0].cfg.StartOffset, startOff)
+	_, err = os.Stat(formatName(0, partition.Name(), ".message"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = partition.Read(startOff - 1)
+	require.Error(t, err)
+	msg, err := partition.Read(startOff)
+	require.NoError(t, err)
+	require.Equal(t, getTestMsgByte(int(startOff)), msg.Value)
+	require.NoError(t, partition.Close())
+
+	// reopen
+	partition, err = NewPartition(topic, config)
+	require.NoError(t, err)
+	require.Equal(t, startOff, partition.StartOffset())
+	require.Equal(t, uint64(99), partition.LatestCommitedOff())
+	require.NoError(t, partition.Close())
+}
+
+func TestPartition_RetentionByAge(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 1024
+	config.RetentionAge = time.Hour
+
+	partition, err := NewPartition("customer_created", config)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		msg := getTestMsg(i)
+		if i < 50 {
+			msg.Timestamp = time.Now().Add(-2 * time.Hour)
+		}
+		_, err := partition.Append(msg)
+		require.NoError(t, err)
+	}
+
+	_, err = partition.EnforceRetention()
+	require.NoError(t, err)
+	startOff := partition.StartOffset()
+	require.Greater(t, startOff, uint64(0))
+	require.LessOrEqual(t, startOff, uint64(50))
+	maxTs, err := partition.segments[0].MaxTimestamp()
+	require.NoError(t, err)
+	require.Greater(t, maxTs, time.Now().Add(-time.Hour).UnixMilli())
+	require.NoError(t, partition.Close())
+}
+
+func TestPartition_BackgroundCleaner(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 1024
+	config.RetentionByte = 1024
+	config.RetentionCheckInterval = 10 * time.Millisecond
+
+	partition, err := NewPartition("customer_created", config)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := partition.Append(getTestMsg(i))
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		return partition.StartOffset() > 0
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, partition.Close())
+}
@@ -1,98 +1,744 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"github.com/vandathron/bcaster/internal/cfg"
+	"github.com/vandathron/bcaster/internal/model"
 	"io"
+	"math"
+	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Segment struct {
-	index      *MsgIdx
-	msgFile    *msgFile
-	cfg        cfg.Segment
-	nextOffset uint64
-	name       string
+	index         *MsgIdx
+	timeIndex     *TimeIdx
+	msgFile       *msgFile
+	cfg           cfg.Segment
+	nextOffset    uint64 // owned by the writer, readers go by flushedOffset
+	bytesSinceIdx uint64 // message bytes appended since the last index entry
+	name          string
+	recovery      RecoveryReport
+	meta          segmentMeta
+	keys          *keyring        // nil unless the partition encrypts its records
+	recordCache   *partitionCache // caches appended messages, nil unless the segment is writable and the partition has a cache
+	lastAppend    time.Time
+	syncLock      sync.Mutex    // held while syncing so concurrent appenders share a single fsync
+	flushedOffset atomic.Uint64 // messages below this offset have been handed to the OS and are visible to readers
+	syncedOffset  atomic.Uint64 // messages below this offset are on stable storage
+}
+
+// RecoveryReport describes what was repaired while reconciling a segment's index and message files on open.
+type RecoveryReport struct {
+	TruncatedBytes   uint64 // torn or corrupt bytes removed from the tail of the message file
+	DroppedEntries   uint64 // index entries removed because they referenced missing data
+	RecoveredEntries uint64 // complete messages that were missing an index entry
+	IndexRebuilt     bool   // index was missing or inconsistent and has been regenerated from the message file
+	TimeIndexRebuilt bool   // time index was missing or inconsistent and has been regenerated from the message file
+}
+
+func (r RecoveryReport) Repaired() bool {
+	return r.TruncatedBytes > 0 || r.DroppedEntries > 0 || r.RecoveredEntries > 0 || r.IndexRebuilt || r.TimeIndexRebuilt
+}
+
+// add counts the repairs of another segment into r.
+func (r *RecoveryReport) add(o RecoveryReport) {
+	r.TruncatedBytes += o.TruncatedBytes
+	r.DroppedEntries += o.DroppedEntries
+	r.RecoveredEntries += o.RecoveredEntries
+	r.IndexRebuilt = r.IndexRebuilt || o.IndexRebuilt
+	r.TimeIndexRebuilt = r.TimeIndexRebuilt || o.TimeIndexRebuilt
 }
 
 func NewSegment(dir string, config cfg.Segment) (*Segment, error) {
+	return newSegment(dir, config, nil)
+}
+
+// newSegment opens a segment whose records are encrypted with the current key of keys when the segment is
+// created. keys may be nil to leave new segments unencrypted.
+func newSegment(dir string, config cfg.Segment, keys *keyring) (*Segment, error) {
 	s := &Segment{
 		cfg:  config,
 		name: formatName(config.StartOffset, dir, ""),
+		keys: keys,
+	}
+	if s.cfg.IdxIntervalByte > 0 && s.cfg.MaxMsgSizeByte > math.MaxUint32 {
+		return nil, fmt.Errorf("sparse index cannot address message file of max size %d", s.cfg.MaxMsgSizeByte)
+	}
+
+	idxName := formatName(s.cfg.StartOffset, dir, ".index")
+	_, err := os.Stat(idxName)
+	if errors.Is(err, os.ErrNotExist) {
+		s.recovery.IndexRebuilt = true // a fresh index gets every message re-indexed by recover()
+	} else if err != nil {
+		return nil, err
+	}
+
+	s.index, err = NewIndex(idxName, cfg.Index{
+		MaxSizeByte:  s.cfg.MaxIdxSizeByte,
+		StartOffset:  s.cfg.StartOffset,
+		IntervalByte: s.cfg.IdxIntervalByte,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	timeIdxName := formatName(s.cfg.StartOffset, dir, ".timeindex")
+	_, err = os.Stat(timeIdxName)
+	if errors.Is(err, os.ErrNotExist) {
+		s.recovery.TimeIndexRebuilt = true
+	} else if err != nil {
+		_ = s.index.Close()
+		return nil, err
 	}
-	var err error
-	s.index, err = NewIndex(formatName(s.cfg.StartOffset, dir, ".index"), cfg.Index{
-		MaxSizeByte: s.cfg.MaxIdxSizeByte,
+
+	maxTimeIdxSize := s.cfg.MaxTimeIdxSizeByte
+	if maxTimeIdxSize == 0 {
+		maxTimeIdxSize = s.cfg.MaxIdxSizeByte
+	}
+	s.timeIndex, err = NewTimeIndex(timeIdxName, cfg.Index{
+		MaxSizeByte: maxTimeIdxSize,
 	})
 	if err != nil {
+		_ = s.index.Close()
 		return nil, err
 	}
 
 	s.msgFile, err = NewMsgFile(formatName(s.cfg.StartOffset, dir, ".message"), s.cfg.MaxMsgSizeByte)
 	if err != nil {
 		_ = s.index.Close()
+		_ = s.timeIndex.Close()
 		return nil, err
 	}
 
-	lastOffset, _, err := s.index.LastEntry()
+	if err = s.loadMeta(); err != nil { // loaded first as recovery reads records, which may need the key
+		_ = s.Close()
+		return nil, err
+	}
 
-	if err == io.EOF { // indicates an empty index file. Next offset should be base offset
-		s.nextOffset = s.cfg.StartOffset
-	} else {
-		s.nextOffset = lastOffset + 1 // Set future entry write offset
+	if err = s.recover(); err != nil {
+		_ = s.Close()
+		return nil, err
 	}
 
+	s.lastAppend = s.meta.CreatedAt
+	if s.nextOffset > s.cfg.StartOffset {
+		info, err := s.msgFile.file.Stat()
+		if err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		s.lastAppend = info.ModTime()
+	}
 	return s, nil
 }
 
-func (s *Segment) Append(msg []byte) (uint64, error) {
-	pos, err := s.msgFile.Append(msg)
+// recover reconciles the index with the message file after an unclean shutdown. Index entries are only
+// trusted up to the last one pointing at an intact message; messages written after it are re-indexed and
+// a torn tail is truncated. An index that is inconsistent before that point is rebuilt entirely.
+func (s *Segment) recover() error {
+	entries := s.index.entryCount()
+	kept := entries
+	for ; kept > 0; kept-- { // walk back to the last entry referencing an intact message
+		if kept > 1 {
+			off, _ := s.index.entryAt(kept - 1)
+			if prevOff, _ := s.index.entryAt(kept - 2); off <= prevOff { // e.g. zeroed by an unclean shutdown
+				continue
+			}
+		}
+		intact, err := s.entryIntact(kept - 1)
+		if err != nil {
+			return err
+		}
+		if intact {
+			break
+		}
+	}
+	if (kept == 0 && entries > 0) || !s.isConsistent(kept) { // nothing trusted or damaged beyond the tail, rebuild from the message file
+		kept = 0
+		s.recovery.IndexRebuilt = true
+	}
+	s.recovery.DroppedEntries = entries - kept
+	if err := s.index.truncate(kept); err != nil {
+		return err
+	}
+
+	s.nextOffset = s.cfg.StartOffset
+	pos := uint64(0)
+	if kept > 0 { // resume from the last trusted entry, which is already indexed
+		s.nextOffset, pos = s.index.entryAt(kept - 1)
+		record, _ := s.msgFile.Read(pos) // verified above
+		s.bytesSinceIdx = uint64(len(record)) + msgHeaderWidth
+		pos += s.bytesSinceIdx
+		s.nextOffset++
+	}
+
+	for pos < s.msgFile.CurrentSize() { // walk messages after the last entry, indexing those that are due
+		record, err := s.msgFile.Read(pos)
+		if errors.Is(err, ErrCorruptRecord) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		off, err := recordOffset(record)
+		if err != nil || off < s.nextOffset { // offsets only increase, with gaps left by compaction
+			break
+		}
+		indexed, err := s.indexRecord(off, pos, uint64(len(record))+msgHeaderWidth)
+		if err == ErrSegmentFull { // refuse to drop intact messages, the configured index is too small for them
+			return fmt.Errorf("index of segment %s is too small to hold offset %d", s.name, off)
+		}
+		if err != nil {
+			return err
+		}
+		if indexed {
+			s.recovery.RecoveredEntries++
+		}
+		s.nextOffset = off + 1
+		pos += uint64(len(record)) + msgHeaderWidth
+	}
+
+	if size := s.msgFile.CurrentSize(); pos < size {
+		s.recovery.TruncatedBytes = size - pos
+		if err := s.msgFile.truncate(pos); err != nil {
+			return err
+		}
+	}
+
+	s.flushedOffset.Store(s.nextOffset)
+	s.syncedOffset.Store(s.nextOffset)
+
+	scanFrom := s.cfg.StartOffset // time index entries may be missing for every message walked above
+	if kept > 0 {
+		scanFrom, _ = s.index.entryAt(kept - 1)
+	}
+	return s.recoverTimeIndex(scanFrom)
+}
+
+// isConsistent reports whether the first n index entries are consistent among themselves and the last of them
+// points at an intact record of the message file.
+func (s *Segment) isConsistent(n uint64) bool {
+	if !s.index.isConsistent(n) {
+		return false
+	}
+	if n == 0 {
+		return true
+	}
+	intact, err := s.entryIntact(n - 1)
+	return err == nil && intact
+}
+
+// entryIntact reports whether index entry e points inside the message file at a record holding the entry's
+// offset.
+func (s *Segment) entryIntact(e uint64) (bool, error) {
+	off, pos := s.index.entryAt(e)
+	if pos >= s.msgFile.CurrentSize() {
+		return false, nil
+	}
+	record, err := s.msgFile.Read(pos)
+	if errors.Is(err, ErrCorruptRecord) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	recordOff, err := recordOffset(record)
+	return err == nil && recordOff == off, nil
+}
+
+// recoverTimeIndex drops time index entries past the end of the segment and re-indexes timestamps of
+// messages from scanFrom onwards. A missing or inconsistent time index is rebuilt from the whole segment.
+func (s *Segment) recoverTimeIndex(scanFrom uint64) error {
+	kept := s.timeIndex.entryCount()
+	for ; kept > 0; kept-- { // zeroed entries are left behind by an unclean shutdown
+		ts, off := s.timeIndex.entryAt(kept - 1)
+		if (ts != 0 || off != 0) && off < s.nextOffset {
+			break
+		}
+	}
+	if err := s.timeIndex.truncate(kept); err != nil {
+		return err
+	}
+
+	if s.recovery.TimeIndexRebuilt || !s.timeIndex.isConsistent() {
+		s.recovery.TimeIndexRebuilt = true
+		scanFrom = s.cfg.StartOffset
+		if err := s.timeIndex.truncate(0); err != nil {
+			return err
+		}
+	}
+
+	for off := scanFrom; off < s.nextOffset; {
+		msg, err := s.Read(off)
+		if err != nil {
+			return err
+		}
+		if err = s.timeIndex.Append(msg.Timestamp.UnixMilli(), msg.Offset); err != nil {
+			return err
+		}
+		off = msg.Offset + 1
+	}
+	return nil
+}
+
+// loadMeta reads the segment's meta file, creating it for new segments and segments written before it
+// existed. A segment is only given a key when its meta file is created, so every encrypted record of a
+// segment is encrypted with the same key.
+func (s *Segment) loadMeta() error {
+	metaName := s.name + ".meta"
+	meta, err := readSegmentMeta(metaName)
+	if errors.Is(err, os.ErrNotExist) {
+		meta.CreatedAt = time.Now()
+		if ts, _ := s.timeIndex.entryAt(0); s.timeIndex.entryCount() > 0 { // best guess for an existing segment
+			meta.CreatedAt = time.UnixMilli(ts)
+		}
+		if s.keys != nil {
+			if meta.KeyID, _, err = s.keys.current(); err != nil {
+				return err
+			}
+		}
+		err = writeSegmentMeta(metaName, meta)
+	}
+	if err != nil {
+		return err
+	}
+	s.meta = meta
+	return nil
+}
+
+// encode encodes msg as a record at off, encrypted when the segment has a key. The plaintext record is
+// returned too.
+func (s *Segment) encode(off uint64, msg model.Msg) (record, plain []byte, err error) {
+	plain, err = encodeRecord(off, msg)
+	if err != nil || s.meta.KeyID == 0 {
+		return plain, plain, err
+	}
+	aead, err := s.keys.aead(s.meta.KeyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	record, err = encryptRecord(aead, plain)
+	return record, plain, err
+}
+
+// decode decodes a record read from the message file, decrypting it first when it is encrypted.
+func (s *Segment) decode(record []byte) (*model.Msg, error) {
+	if recordEncrypted(record) {
+		aead, err := s.keys.aead(s.meta.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		if record, err = decryptRecord(aead, record); err != nil {
+			return nil, err
+		}
+	}
+	return decodeRecord(record)
+}
+
+func (s *Segment) Append(msg model.Msg) (uint64, error) {
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	return s.append(s.nextOffset, msg)
+}
+
+// append writes msg at off, which may skip ahead of the next offset when copying compacted messages.
+func (s *Segment) append(off uint64, msg model.Msg) (uint64, error) {
+	if off < s.nextOffset {
+		return 0, fmt.Errorf("offset %d precedes next offset %d", off, s.nextOffset)
+	}
+	if s.timeIndex.IsMaxedOut() || (s.indexDue() && s.index.freeEntries() == 0) { // checked before the message file is written
+		return 0, ErrSegmentFull
+	}
+	record, plain, err := s.encode(off, msg)
+	if err != nil {
+		return 0, err
+	}
+
+	pos, err := s.msgFile.Append(record)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = s.indexRecord(off, pos, uint64(len(record))+msgHeaderWidth)
 	if err != nil {
 		return 0, err
 	}
 
-	err = s.index.Append(s.nextOffset, pos)
+	err = s.timeIndex.Append(msg.Timestamp.UnixMilli(), off)
 	if err != nil {
 		return 0, err
 	}
 
-	s.nextOffset++
-	return s.nextOffset - 1, nil
+	s.nextOffset = off + 1
+	s.lastAppend = time.Now()
+	if err = s.msgFile.flush(); err != nil {
+		return 0, err
+	}
+	s.flushedOffset.Store(s.nextOffset)
+	s.recordCache.putRecord(plain)
+	return off, nil
+}
+
+// AppendBatch writes the longest prefix of msgs that fits in the segment and returns its length.
+// ErrSegmentFull is returned alongside it when the segment filled up before the whole batch was written.
+func (s *Segment) AppendBatch(msgs []model.Msg) (int, error) {
+	now := time.Now()
+	idxFree, timeIdxFree := s.index.freeEntries(), s.timeIndex.freeEntries()
+	idxEntries, sinceIdx := s.index.entryCount(), s.bytesSinceIdx
+	lastTs, _, err := s.timeIndex.LastEntry()
+	if err == io.EOF {
+		lastTs = math.MinInt64
+	}
+
+	// Only encode messages whose index entries are known to fit, so the message file never gets ahead of
+	// the indexes.
+	records := make([][]byte, 0, len(msgs))
+	var plains [][]byte // kept for the record cache
+	timestamps := make([]int64, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.Timestamp.IsZero() {
+			msg.Timestamp = now
+		}
+		ts := msg.Timestamp.UnixMilli()
+		needsIdx := idxEntries == 0 || sinceIdx >= s.cfg.IdxIntervalByte
+		needsTimeIdx := ts > lastTs
+		if (needsIdx && idxFree == 0) || (needsTimeIdx && timeIdxFree == 0) {
+			break
+		}
+
+		record, plain, err := s.encode(s.nextOffset+uint64(len(records)), msg)
+		if err != nil {
+			return 0, err
+		}
+		records = append(records, record)
+		if s.recordCache != nil {
+			plains = append(plains, plain)
+		}
+		timestamps = append(timestamps, ts)
+
+		if needsIdx {
+			idxFree--
+			idxEntries++
+			sinceIdx = 0
+		}
+		sinceIdx += uint64(len(record)) + msgHeaderWidth
+		if needsTimeIdx {
+			timeIdxFree--
+			lastTs = ts
+		}
+	}
+
+	positions, err := s.msgFile.AppendBatch(records)
+	if err != nil && err != ErrSegmentFull {
+		return 0, err
+	}
+	for i, pos := range positions {
+		if _, err := s.indexRecord(s.nextOffset, pos, uint64(len(records[i]))+msgHeaderWidth); err != nil {
+			return i, err
+		}
+		if err := s.timeIndex.Append(timestamps[i], s.nextOffset); err != nil {
+			return i, err
+		}
+		s.nextOffset++
+	}
+	if len(positions) > 0 {
+		s.lastAppend = time.Now()
+	}
+	s.flushedOffset.Store(s.nextOffset)
+	for _, plain := range plains[:min(len(plains), len(positions))] {
+		s.recordCache.putRecord(plain)
+	}
+
+	if len(positions) < len(msgs) {
+		return len(positions), ErrSegmentFull
+	}
+	return len(positions), nil
 }
 
-func (s *Segment) Read(offset uint64) ([]byte, error) {
-	if offset > s.nextOffset {
+// truncateTo removes every message at or after offset. The message file is truncated before the indexes, a
+// crash in between leaves index entries past its end that recovery drops.
+func (s *Segment) truncateTo(offset uint64) error {
+	if offset >= s.nextOffset {
+		return nil
+	}
+
+	_, pos, err := s.index.Lookup(offset)
+	if err == io.EOF {
+		pos, err = 0, nil
+	}
+	if err != nil {
+		return err
+	}
+	for size := s.msgFile.CurrentSize(); pos < size; { // find the first message to remove
+		record, err := s.msgFile.Read(pos)
+		if err != nil {
+			return err
+		}
+		recordOff, err := recordOffset(record)
+		if err != nil {
+			return &CorruptRecordError{Pos: pos, Reason: err.Error()}
+		}
+		if recordOff >= offset {
+			break
+		}
+		pos += uint64(len(record)) + msgHeaderWidth
+	}
+	if err = s.msgFile.truncate(pos); err != nil {
+		return err
+	}
+
+	kept := uint64(sort.Search(int(s.index.entryCount()), func(e int) bool {
+		off, _ := s.index.entryAt(uint64(e))
+		return off >= offset
+	}))
+	if err = s.index.truncate(kept); err != nil {
+		return err
+	}
+	s.bytesSinceIdx = 0
+	if kept > 0 {
+		_, lastPos := s.index.entryAt(kept - 1)
+		s.bytesSinceIdx = pos - lastPos
+	}
+
+	keptTs := uint64(sort.Search(int(s.timeIndex.entryCount()), func(e int) bool {
+		_, off := s.timeIndex.entryAt(uint64(e))
+		return off >= offset
+	}))
+	if err = s.timeIndex.truncate(keptTs); err != nil {
+		return err
+	}
+
+	s.nextOffset = max(offset, s.cfg.StartOffset)
+	s.flushedOffset.Store(s.nextOffset)
+	if s.syncedOffset.Load() > s.nextOffset {
+		s.syncedOffset.Store(s.nextOffset)
+	}
+	return nil
+}
+
+// indexRecord adds an index entry for the message at pos once enough bytes have been written since the
+// previous entry. The first message of a segment is always indexed.
+func (s *Segment) indexRecord(off, pos, width uint64) (indexed bool, err error) {
+	if s.indexDue() {
+		if err = s.index.Append(off, pos); err != nil {
+			return false, err
+		}
+		s.bytesSinceIdx = 0
+		indexed = true
+	}
+	s.bytesSinceIdx += width
+	return indexed, nil
+}
+
+// indexDue reports whether the next message appended gets an index entry.
+func (s *Segment) indexDue() bool {
+	return s.index.entryCount() == 0 || s.bytesSinceIdx >= s.cfg.IdxIntervalByte
+}
+
+// Read returns the first message at or after offset, which is offset itself unless it was compacted away.
+// io.EOF is returned when the segment holds no such message.
+func (s *Segment) Read(offset uint64) (*model.Msg, error) {
+	end := s.flushedOffset.Load()
+	if offset >= end {
 		return nil, io.EOF // Offset not within segment
 	}
 
-	pos, err := s.index.Read(offset - s.cfg.StartOffset)
+	_, pos, err := s.index.Lookup(offset)
+	if err == io.EOF { // offset precedes the first indexed message, scan from the start
+		pos, err = 0, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	msg, err := s.msgFile.Read(pos)
+	var record []byte
+	for { // scan forward from the indexed position to the requested offset
+		if pos >= s.msgFile.CurrentSize() {
+			return nil, io.EOF
+		}
+		record, err = s.msgFile.Read(pos)
+		if err != nil {
+			return nil, err
+		}
+		recordOff, err := recordOffset(record)
+		if err != nil {
+			return nil, &CorruptRecordError{Pos: pos, Reason: err.Error()}
+		}
+		if recordOff >= end { // written by an append that has not completed yet
+			return nil, io.EOF
+		}
+		if recordOff >= offset {
+			break
+		}
+		pos += uint64(len(record)) + msgHeaderWidth
+	}
+
+	msg, err := s.decode(record)
 	if err != nil {
+		var corruptErr *CorruptRecordError
+		if errors.As(err, &corruptErr) {
+			corruptErr.Pos = pos
+		}
 		return nil, err
 	}
 	return msg, nil
 }
 
+// readRangeChunkByte bounds a single read of readRange, which reads on until a limit is reached.
+const readRangeChunkByte = 64 * 1024
+
+// readRange returns up to maxMessages messages from offset from onwards whose framed size, added to used,
+// stays within maxBytes. A message larger than the whole budget is still returned when used is zero so
+// readers always make progress. io.EOF is returned, possibly alongside messages, when the end of the
+// segment was reached before either limit.
+func (s *Segment) readRange(from uint64, maxMessages int, maxBytes, used uint64) ([]*model.Msg, uint64, error) {
+	end := s.flushedOffset.Load()
+	if from >= end {
+		return nil, used, io.EOF
+	}
+
+	_, pos, err := s.index.Lookup(from)
+	if err == io.EOF {
+		pos, err = 0, nil
+	}
+	if err != nil {
+		return nil, used, err
+	}
+
+	var msgs []*model.Msg
+	for len(msgs) < maxMessages && (used < maxBytes || used == 0) {
+		// the indexed position may precede from by up to an index interval, read past it in the same call. Reads
+		// are capped so a few messages are not read with the rest of the segment when maxBytes is large
+		budget := min(maxBytes-min(used, maxBytes), readRangeChunkByte)
+		records, err := s.msgFile.ReadFrames(pos, budget+s.cfg.IdxIntervalByte)
+		if err == io.EOF {
+			return msgs, used, io.EOF
+		}
+		if err != nil {
+			return nil, used, err
+		}
+
+		for _, record := range records {
+			width := uint64(len(record)) + msgHeaderWidth
+			recordOff, err := recordOffset(record)
+			if err != nil {
+				return nil, used, &CorruptRecordError{Pos: pos, Reason: err.Error()}
+			}
+			if recordOff >= end {
+				return msgs, used, io.EOF
+			}
+			if recordOff >= from {
+				if used > 0 && used+width > maxBytes {
+					return msgs, used, nil
+				}
+				msg, err := s.decode(record)
+				if err != nil {
+					var corruptErr *CorruptRecordError
+					if errors.As(err, &corruptErr) {
+						corruptErr.Pos = pos
+					}
+					return nil, used, err
+				}
+				msgs = append(msgs, msg)
+				used += width
+				if len(msgs) == maxMessages {
+					return msgs, used, nil
+				}
+			}
+			pos += width
+		}
+	}
+	return msgs, used, nil
+}
+
+// forEach calls fn with every message in the segment, in offset order.
+func (s *Segment) forEach(fn func(msg *model.Msg) error) error {
+	for off := s.cfg.StartOffset; off < s.nextOffset; {
+		msg, err := s.Read(off)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(msg); err != nil {
+			return err
+		}
+		off = msg.Offset + 1
+	}
+	return nil
+}
+
+// OffsetForTime returns the first offset in the segment with a timestamp of at least ts (unix ms).
+func (s *Segment) OffsetForTime(ts int64) (uint64, error) {
+	return s.timeIndex.Lookup(ts)
+}
+
+// MaxTimestamp returns the largest message timestamp (unix ms) in the segment.
+func (s *Segment) MaxTimestamp() (int64, error) {
+	ts, _, err := s.timeIndex.LastEntry()
+	return ts, err
+}
+
 func (s *Segment) Close() error {
 	err := s.msgFile.Close()
 	if err != nil {
 		return err
 	}
+	if err = s.timeIndex.Close(); err != nil {
+		return err
+	}
 	return s.index.Close()
 }
 
+// Remove closes the segment and deletes its files.
+func (s *Segment) Remove() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	for _, ext := range []string{".message", ".index", ".timeindex", ".meta"} {
+		if err := os.Remove(s.name + ext); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns the size of the segment's message file in bytes.
+func (s *Segment) Size() uint64 {
+	return s.msgFile.CurrentSize()
+}
+
+// Recovery reports what was repaired when the segment was opened.
+func (s *Segment) Recovery() RecoveryReport {
+	return s.recovery
+}
+
 func (s *Segment) LatestCommittedOff() uint64 {
-	return s.nextOffset - 1
+	return s.flushedOffset.Load() - 1
 }
 
 func formatName(startOffset uint64, dir, ext string) string {
 	return filepath.Join(dir, fmt.Sprintf("%d%s", startOffset, ext))
 }
 
+// isExpired reports whether the segment has been open for longer than MaxAge or idle for longer than
+// MaxIdle. An empty segment never expires as rolling it would not make room for anything.
+func (s *Segment) isExpired(now time.Time) bool {
+	if s.nextOffset == s.cfg.StartOffset {
+		return false
+	}
+	return (s.cfg.MaxAge > 0 && now.Sub(s.meta.CreatedAt) >= s.cfg.MaxAge) ||
+		(s.cfg.MaxIdle > 0 && now.Sub(s.lastAppend) >= s.cfg.MaxIdle)
+}
+
 func (s *Segment) IsFull() bool {
-	return s.index.IsMaxedOut() || s.msgFile.IsMaxedOut()
+	return s.index.IsMaxedOut() || s.timeIndex.IsMaxedOut() || s.msgFile.IsMaxedOut()
 }
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	metaVersionV1    = byte(1)
+	metaVersionV2    = byte(2) // adds the key id
+	metaVersionWidth = 1
+	metaCreatedWidth = 8 // creation time in unix milliseconds
+	metaWidthV1      = metaVersionWidth + metaCreatedWidth
+	metaWidthV2      = metaWidthV1 + keyIDWidth
+)
+
+// segmentMeta holds the properties of a segment that cannot be derived from its messages.
+type segmentMeta struct {
+	CreatedAt time.Time
+	KeyID     uint32 // key the segment's records are encrypted with, zero when they are not
+}
+
+func readSegmentMeta(name string) (segmentMeta, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return segmentMeta{}, err
+	}
+	if len(b) < metaWidthV1 || (b[0] != metaVersionV1 && b[0] != metaVersionV2) || (b[0] == metaVersionV2 && len(b) < metaWidthV2) {
+		return segmentMeta{}, fmt.Errorf("invalid segment meta file: %s", name)
+	}
+	createdAt := int64(binary.BigEndian.Uint64(b[metaVersionWidth:metaWidthV1]))
+	m := segmentMeta{CreatedAt: time.UnixMilli(createdAt)}
+	if b[0] == metaVersionV2 {
+		m.KeyID = binary.BigEndian.Uint32(b[metaWidthV1:metaWidthV2])
+	}
+	return m, nil
+}
+
+// writeSegmentMeta replaces the meta file atomically so a crash leaves either the old or the new version.
+func writeSegmentMeta(name string, m segmentMeta) error {
+	b := make([]byte, metaWidthV2)
+	b[0] = metaVersionV2
+	binary.BigEndian.PutUint64(b[metaVersionWidth:], uint64(m.CreatedAt.UnixMilli()))
+	binary.BigEndian.PutUint32(b[metaWidthV1:], m.KeyID)
+
+	return writeFileAtomic(name, b)
+}
+
+// writeFileAtomic replaces name with b through a synced temporary file.
+func writeFileAtomic(name string, b []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"github.com/stretchr/testify/require"
 	"github.com/vandathron/bcaster/internal/cfg"
+	"github.com/vandathron/bcaster/internal/model"
 	"io"
 	"os"
 	"testing"
+	"time"
 )
 
 const (
@@ -31,11 +33,11 @@ func TestNewSegment(t *testing.T) {
 
 	testMaxSize(t, maxIdxSizeByte, maxMessageSizeByte, segment)
 	msgByte, err := json.Marshal(message{Name: "Tosin", Event: "Test Segment"})
-	msgSize := uint64(len(msgByte))
+	msgSize := uint64(recordSize(model.Msg{Value: msgByte}))
 	require.NoError(t, err)
-	off, err := segment.Append(msgByte)
+	off, err := segment.Append(model.Msg{Value: msgByte})
 	require.NoError(t, err)
-	require.Equal(t, segment.msgFile.currSize, msgSize+8) // 8 bytes inclusive considering the length of message saved in an 8 bytes block
+	require.Equal(t, segment.msgFile.currSize, msgSize+msgHeaderWidth) // 12 bytes inclusive considering the length and checksum of record saved in a 12 bytes block
 	require.Equal(t, uint64(0), off)
 	require.NoError(t, segment.Close())
 }
@@ -55,17 +57,17 @@ func TestSegment_Read(t *testing.T) {
 	require.NoError(t, err)
 	testMaxSize(t, maxIdxSizeByte, maxMessageSizeByte, segment)
 	msgByte, err := json.Marshal(message{Name: "Tosin", Event: "Test Segment"})
-	msgSize := uint64(len(msgByte))
+	msgSize := uint64(recordSize(model.Msg{Value: msgByte}))
 	require.NoError(t, err)
-	off, err := segment.Append(msgByte)
+	off, err := segment.Append(model.Msg{Value: msgByte})
 	require.NoError(t, err)
-	require.Equal(t, segment.msgFile.currSize, msgSize+8)
+	require.Equal(t, segment.msgFile.currSize, msgSize+msgHeaderWidth)
 	require.Equal(t, uint64(1), segment.nextOffset)
 	require.Equal(t, uint64(0), off)
 	msg, err := segment.Read(0)
 	require.NoError(t, err)
 	m := &message{}
-	err = json.Unmarshal(msg, m)
+	err = json.Unmarshal(msg.Value, m)
 	require.NoError(t, err)
 	require.Equal(t, "Tosin", m.Name)
 	require.Equal(t, "Test Segment", m.Event)
@@ -79,20 +81,20 @@ func TestSegment_Full(t *testing.T) {
 
 	c := cfg.Segment{
 		MaxIdxSizeByte: uint64(300),
-		MaxMsgSizeByte: uint64(300),
+		MaxMsgSizeByte: uint64(450),
 		StartOffset:    0,
 	}
 
 	segment, err := NewSegment(dir, c)
 	require.NoError(t, err)
-	testMaxSize(t, 300, 300, segment)
+	testMaxSize(t, 300, 450, segment)
 	msgByte, err := json.Marshal(message{Name: "Tosin", Event: "Test Segment"})
 	require.NoError(t, err)
-	msgBlockSize := uint64(len(msgByte)) + 8 // msgSize is roughly 39 bytes + 8 bytes = 47 bytes
-	for i := 0; i < 10; i++ {                // msgSize + 8 = roughly
-		offset, err := segment.Append(msgByte)
+	msgBlockSize := uint64(recordSize(model.Msg{Value: msgByte})) + msgHeaderWidth // msgSize is roughly 39 bytes + 30 bytes record overhead + 12 bytes = 81 bytes
+	for i := 0; i < 10; i++ {
+		offset, err := segment.Append(model.Msg{Value: msgByte})
 		if i >= 5 { // TODO: Check msgblocksize. Initially 6 records, changed to 5 to pass test
-			require.Error(t, io.EOF, err)
+			require.ErrorIs(t, err, ErrSegmentFull)
 			continue
 		}
 		require.Equal(t, uint64(i+1), segment.nextOffset)
@@ -120,9 +122,9 @@ func TestSegment_ExistingSegment(t *testing.T) {
 	require.NoError(t, err)
 	testMaxSize(t, 300, 300, segment)
 	msgByte, err := json.Marshal(message{Name: "Tosin", Event: "Test Segment"})
-	msgBlockSize := uint64(len(msgByte)) + 8
+	msgBlockSize := uint64(recordSize(model.Msg{Value: msgByte})) + msgHeaderWidth
 	require.NoError(t, err)
-	offset, err := segment.Append(msgByte)
+	offset, err := segment.Append(model.Msg{Value: msgByte})
 	require.Equal(t, uint64(0), offset)
 	require.NoError(t, err)
 	require.NoError(t, segment.Close())
@@ -132,9 +134,9 @@ func TestSegment_ExistingSegment(t *testing.T) {
 
 	msgByte2, err := segment2.Read(uint64(0))
 	require.NoError(t, err)
-	require.Equal(t, msgByte, msgByte2)
+	require.Equal(t, msgByte, msgByte2.Value)
 	require.Equal(t, uint64(1), segment2.nextOffset)
-	offset, err = segment2.Append(msgByte)
+	offset, err = segment2.Append(model.Msg{Value: msgByte})
 	require.NoError(t, err)
 	require.Equal(t, uint64(1), offset)
 	require.Equal(t, msgBlockSize*2, segment2.msgFile.currSize) // confirm 2 messages were appended
@@ -151,3 +153,259 @@ type message struct {
 	Event string
 	Id    int
 }
+
+func TestSegment_IsConsistent(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := cfg.Segment{MaxIdxSizeByte: maxIdxSizeByte, MaxMsgSizeByte: maxMessageSizeByte}
+	segment, err := NewSegment(dir, c)
+	require.NoError(t, err)
+	defer segment.Close()
+	for i := 0; i < 3; i++ {
+		_, err = segment.Append(getTestMsg(i))
+		require.NoError(t, err)
+	}
+	require.True(t, segment.isConsistent(3))
+
+	// the last entry must point at a whole record holding its offset
+	_, lastPos := segment.index.entryAt(2)
+	require.NoError(t, segment.msgFile.truncate(lastPos+5))
+	require.False(t, segment.isConsistent(3))
+	require.NoError(t, segment.msgFile.truncate(lastPos))
+	require.False(t, segment.isConsistent(3))
+	require.True(t, segment.isConsistent(2))
+}
+
+func TestSegment_RecoverTornTail(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := cfg.Segment{
+		MaxIdxSizeByte: uint64(1024),
+		MaxMsgSizeByte: uint64(1024 * 3),
+		StartOffset:    0,
+	}
+	msgByte, err := json.Marshal(message{Name: "Tosin", Event: "Test Segment"})
+	require.NoError(t, err)
+	msgBlockSize := uint64(recordSize(model.Msg{Value: msgByte})) + msgHeaderWidth
+
+	segment, err := NewSegment(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = segment.Append(model.Msg{Value: msgByte})
+		require.NoError(t, err)
+	}
+	require.NoError(t, segment.Close())
+
+	// crash mid-write of the last message, leaving its index entry behind
+	require.NoError(t, os.Truncate(formatName(0, dir, ".message"), int64(3*msgBlockSize-5)))
+	segment, err = NewSegment(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, RecoveryReport{TruncatedBytes: msgBlockSize - 5, DroppedEntries: 1}, segment.Recovery())
+	require.Equal(t, uint64(2), segment.nextOffset)
+	require.Equal(t, 2*msgBlockSize, segment.msgFile.CurrentSize())
+	require.Equal(t, 2*uint64(indexEntryWidth), segment.index.currSize)
+	_, err = segment.Read(2)
+	require.Error(t, err)
+
+	off, err := segment.Append(model.Msg{Value: msgByte})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.NoError(t, segment.Close())
+}
+
+func TestSegment_RecoverIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := cfg.Segment{
+		MaxIdxSizeByte: uint64(1024),
+		MaxMsgSizeByte: uint64(1024 * 3),
+		StartOffset:    10,
+	}
+	msgByte, err := json.Marshal(message{Name: "Tosin", Event: "Test Segment"})
+	require.NoError(t, err)
+
+	segment, err := NewSegment(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = segment.Append(model.Msg{Value: msgByte})
+		require.NoError(t, err)
+	}
+	require.NoError(t, segment.Close())
+
+	// unclean shutdown leaves the memory-mapped index at its max size
+	require.NoError(t, os.Truncate(formatName(10, dir, ".index"), int64(c.MaxIdxSizeByte)))
+	segment, err = NewSegment(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, c.MaxIdxSizeByte/indexEntryWidth-3, segment.Recovery().DroppedEntries)
+	require.Equal(t, uint64(13), segment.nextOffset)
+	require.NoError(t, segment.Close())
+
+	// messages flushed without their index entries are re-indexed
+	require.NoError(t, os.Truncate(formatName(10, dir, ".index"), int64(indexEntryWidth)))
+	segment, err = NewSegment(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, RecoveryReport{RecoveredEntries: 2}, segment.Recovery())
+	require.Equal(t, uint64(13), segment.nextOffset)
+	for off := uint64(10); off < 13; off++ {
+		msg, err := segment.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, msgByte, msg.Value)
+	}
+	require.NoError(t, segment.Close())
+}
+
+func TestSegment_RebuildIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := cfg.Segment{
+		MaxIdxSizeByte: uint64(1024),
+		MaxMsgSizeByte: uint64(1024 * 3),
+		StartOffset:    0,
+	}
+	idxName := formatName(0, dir, ".index")
+
+	segment, err := NewSegment(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		msgByte, err := json.Marshal(message{Name: "Tosin", Event: "Test Segment", Id: i})
+		require.NoError(t, err)
+		_, err = segment.Append(model.Msg{Value: msgByte})
+		require.NoError(t, err)
+	}
+	require.NoError(t, segment.Close())
+
+	requireRebuilt := func() {
+		segment, err = NewSegment(dir, c)
+		require.NoError(t, err)
+		require.True(t, segment.Recovery().Repaired())
+		require.Equal(t, uint64(5), segment.nextOffset)
+		for i := 0; i < 5; i++ {
+			msg, err := segment.Read(uint64(i))
+			require.NoError(t, err)
+			m := message{}
+			require.NoError(t, json.Unmarshal(msg.Value, &m))
+			require.Equal(t, i, m.Id)
+		}
+		require.NoError(t, segment.Close())
+	}
+
+	// missing index
+	require.NoError(t, os.Remove(idxName))
+	requireRebuilt()
+
+	require.True(t, segment.Recovery().IndexRebuilt)
+
+	// zero-filled index
+	require.NoError(t, os.WriteFile(idxName, make([]byte, 5*indexEntryWidth), 0666))
+	requireRebuilt()
+	require.Equal(t, uint64(4), segment.Recovery().RecoveredEntries)
+
+	// damaged entry ahead of a valid tail
+	flipByte(t, idxName, indexEntryWidth+offsetWidth-1)
+	requireRebuilt()
+	require.True(t, segment.Recovery().IndexRebuilt)
+}
+
+func TestSegment_SparseIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := cfg.Segment{
+		MaxIdxSizeByte:  uint64(1024),
+		MaxMsgSizeByte:  uint64(1024 * 16),
+		StartOffset:     20,
+		IdxIntervalByte: 400,
+	}
+
+	segment, err := NewSegment(dir, c)
+	require.NoError(t, err)
+	var msgs [][]byte
+	for i := 0; i < 100; i++ {
+		msgByte, err := json.Marshal(message{Name: "Tosin", Event: "Test Segment", Id: i})
+		require.NoError(t, err)
+		msgs = append(msgs, msgByte)
+		off, err := segment.Append(model.Msg{Value: msgByte})
+		require.NoError(t, err)
+		require.Equal(t, uint64(20+i), off)
+	}
+	msgBlockSize := uint64(recordSize(model.Msg{Value: msgs[0]})) + msgHeaderWidth
+	perEntry := (c.IdxIntervalByte + msgBlockSize - 1) / msgBlockSize
+	entries := (100 + perEntry - 1) / perEntry
+	require.Equal(t, entries*sparseIndexEntryWidth, segment.index.currSize)
+
+	requireReads := func() {
+		for i := 0; i < 100; i++ {
+			msg, err := segment.Read(uint64(20 + i))
+			require.NoError(t, err)
+			require.Equal(t, msgs[i], msg.Value)
+		}
+		_, err = segment.Read(segment.nextOffset)
+		require.Equal(t, io.EOF, err)
+	}
+	requireReads()
+	require.NoError(t, segment.Close())
+
+	// reopen
+	segment, err = NewSegment(dir, c)
+	require.NoError(t, err)
+	require.False(t, segment.Recovery().Repaired())
+	require.Equal(t, uint64(120), segment.nextOffset)
+	requireReads()
+	off, err := segment.Append(model.Msg{Value: msgs[0]})
+	require.NoError(t, err)
+	require.Equal(t, uint64(120), off)
+	require.NoError(t, segment.Close())
+
+	// switching to a dense index rebuilds it, provided it has room for every message
+	c.IdxIntervalByte = 0
+	_, err = NewSegment(dir, c)
+	require.Error(t, err)
+	c.MaxIdxSizeByte = 1024 * 4
+	segment, err = NewSegment(dir, c)
+	require.NoError(t, err)
+	require.True(t, segment.Recovery().Repaired())
+	require.Equal(t, uint64(101*indexEntryWidth), segment.index.currSize)
+	requireReads()
+	require.NoError(t, segment.Close())
+}
+
+func TestSegment_Meta(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := cfg.Segment{MaxIdxSizeByte: maxIdxSizeByte, MaxMsgSizeByte: maxMessageSizeByte}
+
+	segment, err := NewSegment(dir, c)
+	require.NoError(t, err)
+	createdAt := segment.meta.CreatedAt
+	require.WithinDuration(t, time.Now(), createdAt, time.Second)
+	_, err = segment.Append(model.Msg{Value: []byte("hello")})
+	require.NoError(t, err)
+	require.NoError(t, segment.Close())
+
+	time.Sleep(5 * time.Millisecond)
+	segment, err = NewSegment(dir, c) // creation time survives a restart
+	require.NoError(t, err)
+	require.Equal(t, createdAt.UnixMilli(), segment.meta.CreatedAt.UnixMilli())
+	require.NoError(t, segment.Close())
+
+	// a segment written before meta files existed takes the timestamp of its first message
+	require.NoError(t, os.Remove(formatName(0, dir, ".meta")))
+	segment, err = NewSegment(dir, c)
+	require.NoError(t, err)
+	firstTs, _ := segment.timeIndex.entryAt(0)
+	require.Equal(t, firstTs, segment.meta.CreatedAt.UnixMilli())
+
+	require.NoError(t, segment.Remove())
+	_, err = os.Stat(formatName(0, dir, ".meta"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"github.com/vandathron/bcaster/internal/cfg"
+	"time"
+)
+
+// waitDurable blocks until the message at off satisfies the segment's sync policy.
+func (s *Segment) waitDurable(off uint64) error {
+	switch s.cfg.SyncPolicy {
+	case cfg.SyncAlways:
+		return s.syncThrough(off)
+	case cfg.SyncEveryN:
+		if off+1-s.syncedOffset.Load() >= max(s.cfg.SyncEveryMessages, 1) {
+			return s.syncThrough(off)
+		}
+	}
+	return nil
+}
+
+// syncThrough makes every message up to and including off durable. Appenders queued behind an in-flight
+// sync usually find their message already covered by it and return without issuing another fsync.
+func (s *Segment) syncThrough(off uint64) error {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+	if s.syncedOffset.Load() > off {
+		return nil
+	}
+	return s.syncLocked()
+}
+
+// sync makes every message appended so far durable.
+func (s *Segment) sync() error {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+	return s.syncLocked()
+}
+
+// syncLocked commits the message file before the indexes so a durable index entry never references a
+// message that could still be lost.
+func (s *Segment) syncLocked() error {
+	flushed := s.flushedOffset.Load()
+	if err := s.msgFile.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.Sync(); err != nil {
+		return err
+	}
+	if flushed > s.syncedOffset.Load() {
+		s.syncedOffset.Store(flushed)
+	}
+	return nil
+}
+
+// runSyncer periodically syncs the writable segment for partitions using cfg.SyncInterval.
+func (p *Partition) runSyncer() {
+	defer p.background.Done()
+
+	ticker := time.NewTicker(p.cfg.Segment.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.segLock.RLock()
+			segment := p.writableSegment
+			p.segLock.RUnlock()
+			_ = segment.sync() // retried on the next tick
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/vandathron/bcaster/internal/cfg"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPartition_SyncPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy cfg.SyncPolicy
+		every  uint64
+		synced []uint64 // expected synced offset after each of 5 appends
+	}{
+		{name: "os", policy: cfg.SyncOS, synced: []uint64{0, 0, 0, 0, 0}},
+		{name: "always", policy: cfg.SyncAlways, synced: []uint64{1, 2, 3, 4, 5}},
+		{name: "every n", policy: cfg.SyncEveryN, every: 2, synced: []uint64{0, 2, 2, 4, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "test_partition")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			config := getPartitionConfig(dir)
+			config.SyncPolicy = tt.policy
+			config.SyncEveryMessages = tt.every
+
+			partition, err := NewPartition("customer_created", config)
+			require.NoError(t, err)
+			defer partition.Close()
+			for i, want := range tt.synced {
+				_, err := partition.Append(getTestMsg(i))
+				require.NoError(t, err)
+				require.Equal(t, want, partition.writableSegment.syncedOffset.Load())
+			}
+		})
+	}
+}
+
+func TestPartition_SyncInterval(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := getPartitionConfig(dir)
+	config.SyncPolicy = cfg.SyncInterval
+	config.SyncInterval = 10 * time.Millisecond
+
+	partition, err := NewPartition("customer_created", config)
+	require.NoError(t, err)
+	defer partition.Close()
+	for i := 0; i < 3; i++ {
+		_, err := partition.Append(getTestMsg(i))
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return partition.writableSegment.syncedOffset.Load() == 3
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestPartition_GroupCommit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 4096
+	config.SyncPolicy = cfg.SyncAlways
+
+	partition, err := NewPartition("customer_created", config)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				_, err := partition.Append(getTestMsg(w*25 + i))
+				require.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	require.Greater(t, len(partition.segments), 1)
+	for _, s := range partition.segments {
+		require.Equal(t, s.nextOffset, s.syncedOffset.Load()) // rolled segments are synced in full
+	}
+	require.NoError(t, partition.Close())
+
+	partition, err = NewPartition("customer_created", config)
+	require.NoError(t, err)
+	defer partition.Close()
+	require.Equal(t, uint64(199), partition.LatestCommitedOff())
+}
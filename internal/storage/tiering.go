@@ -0,0 +1,470 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/vandathron/bcaster/internal/cfg"
+	"github.com/vandathron/bcaster/internal/model"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	manifestExt        = ".manifest"
+	manifestVersionV1  = byte(1)
+	manifestWidthV1    = 1 + 4*offsetWidth // version, base offset, next offset, size and max timestamp
+	noMessageTimestamp = math.MinInt64     // max timestamp recorded for a segment without messages
+)
+
+var ErrTieringDisabled = errors.New("tiering is not enabled")
+
+// tieredExts are the segment files copied to the remote store. The manifest is written after them, so a
+// segment only exists remotely once its manifest does.
+var tieredExts = []string{".message", ".index", ".timeindex", ".meta"}
+
+// remoteSegment describes a segment whose files live in the remote store.
+type remoteSegment struct {
+	baseOffset   uint64
+	nextOffset   uint64
+	size         uint64
+	maxTimestamp int64
+}
+
+// tiering tracks the segments a partition has offloaded and the local copies fetched back for reads.
+type tiering struct {
+	remote   RemoteStore
+	cfg      cfg.Tiering
+	prefix   string
+	cacheDir string
+	segCfg   cfg.Segment
+	keys     *keyring
+	lock     sync.Mutex
+	segments []remoteSegment     // oldest first, every one preceding the partition's local segments
+	cache    map[uint64]*Segment // fetched segments by base offset
+	lru      []uint64            // base offsets of cached segments, least recently used first
+}
+
+// EnableTiering offloads closed segments to remote once their newest message falls outside the local
+// retention window and serves reads of offloaded offsets from a local cache. It should be called once,
+// before the partition is shared. The cache directory is emptied, so it may not hold the partition's own.
+func (p *Partition) EnableTiering(remote RemoteStore, c cfg.Tiering) error {
+	if c.CacheDir == "" {
+		return errors.New("tiering needs a cache directory")
+	}
+	cacheDir := filepath.Join(c.CacheDir, fmt.Sprintf("part_%s", p.topic))
+	if inside, err := isWithin(p.Name(), cacheDir); err != nil || inside {
+		if err == nil {
+			err = fmt.Errorf("cache directory %s holds the partition directory %s", cacheDir, p.Name())
+		}
+		return err
+	}
+
+	t := &tiering{
+		remote:   remote,
+		cfg:      c,
+		prefix:   fmt.Sprintf("part_%s/", p.topic),
+		cacheDir: cacheDir,
+		segCfg:   p.cfg.Segment,
+		keys:     p.keys,
+		cache:    make(map[uint64]*Segment),
+	}
+	if err := os.RemoveAll(t.cacheDir); err != nil { // fetched copies may be stale after a restart
+		return err
+	}
+	if err := os.MkdirAll(t.cacheDir, 0750); err != nil {
+		return err
+	}
+
+	keys, err := remote.List(t.prefix)
+	if err != nil {
+		return err
+	}
+	p.segLock.Lock()
+	defer p.segLock.Unlock()
+	localStart := p.segments[0].cfg.StartOffset
+	for _, key := range keys {
+		if path.Ext(key) != manifestExt {
+			continue
+		}
+		rs, err := t.readManifest(key)
+		if err != nil {
+			return err
+		}
+		if rs.baseOffset >= localStart { // offloaded before a crash but not deleted locally, the local copy wins
+			continue
+		}
+		t.segments = append(t.segments, rs)
+	}
+	sort.Slice(t.segments, func(i, j int) bool {
+		return t.segments[i].baseOffset < t.segments[j].baseOffset
+	})
+	p.tier = t
+
+	if c.CheckInterval > 0 {
+		p.background.Add(1)
+		go p.runTiering()
+	}
+	return nil
+}
+
+// isWithin reports whether name is dir or lies inside it.
+func isWithin(name, dir string) (bool, error) {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return false, err
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(dir, name)
+	if err != nil {
+		return false, err
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+// Offload uploads the oldest closed segments whose newest message is older than the local retention
+// window and deletes their local files.
+func (p *Partition) Offload() (offloaded int, err error) {
+	if p.tier == nil {
+		return 0, ErrTieringDisabled
+	}
+	p.cleanLock.Lock()
+	defer p.cleanLock.Unlock()
+
+	p.segLock.RLock()
+	var closed []*Segment
+	for _, s := range p.segments {
+		if s != p.writableSegment {
+			closed = append(closed, s)
+		}
+	}
+	p.segLock.RUnlock()
+
+	deadline := time.Now().Add(-p.tier.cfg.LocalRetention).UnixMilli()
+	for _, s := range closed {
+		maxTs, err := s.MaxTimestamp()
+		if err == io.EOF {
+			maxTs = noMessageTimestamp
+		} else if err != nil {
+			return offloaded, err
+		}
+		if maxTs >= deadline { // later segments are kept locally too, so offloaded ones always precede local ones
+			break
+		}
+
+		rs, err := p.tier.upload(s, maxTs)
+		if err != nil {
+			return offloaded, err
+		}
+
+		p.segLock.Lock()
+		p.segments = p.segments[1:] // s is the oldest local segment, cleanLock keeps it in place
+		p.tier.lock.Lock()
+		p.tier.segments = append(p.tier.segments, rs)
+		p.tier.lock.Unlock()
+		err = s.Remove()
+		p.segLock.Unlock()
+		if err != nil {
+			return offloaded, err
+		}
+		offloaded++
+	}
+	return offloaded, nil
+}
+
+// runTiering periodically offloads closed segments.
+func (p *Partition) runTiering() {
+	defer p.background.Done()
+
+	ticker := time.NewTicker(p.tier.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			_, _ = p.Offload() // retried on the next tick
+		}
+	}
+}
+
+func (t *tiering) upload(s *Segment, maxTs int64) (remoteSegment, error) {
+	base := s.cfg.StartOffset
+	for _, ext := range tieredExts {
+		var r io.Reader
+		switch ext {
+		case ".index": // index files are padded to their max size while open, only upload the entries
+			r = bytes.NewReader(s.index.mmap[:s.index.currSize])
+		case ".timeindex":
+			r = bytes.NewReader(s.timeIndex.mmap[:s.timeIndex.currSize])
+		default:
+			f, err := os.Open(s.name + ext)
+			if err != nil {
+				return remoteSegment{}, err
+			}
+			defer f.Close()
+			r = f
+		}
+		if err := t.remote.Put(t.key(base, ext), r); err != nil {
+			return remoteSegment{}, err
+		}
+	}
+
+	rs := remoteSegment{
+		baseOffset:   base,
+		nextOffset:   s.flushedOffset.Load(),
+		size:         s.Size(),
+		maxTimestamp: maxTs,
+	}
+	return rs, t.remote.Put(t.key(base, manifestExt), bytes.NewReader(encodeManifest(rs)))
+}
+
+func (t *tiering) key(base uint64, ext string) string {
+	return fmt.Sprintf("%s%d%s", t.prefix, base, ext)
+}
+
+func encodeManifest(rs remoteSegment) []byte {
+	b := make([]byte, manifestWidthV1)
+	b[0] = manifestVersionV1
+	binary.BigEndian.PutUint64(b[1:], rs.baseOffset)
+	binary.BigEndian.PutUint64(b[1+offsetWidth:], rs.nextOffset)
+	binary.BigEndian.PutUint64(b[1+2*offsetWidth:], rs.size)
+	binary.BigEndian.PutUint64(b[1+3*offsetWidth:], uint64(rs.maxTimestamp))
+	return b
+}
+
+func (t *tiering) readManifest(key string) (remoteSegment, error) {
+	base, err := strconv.ParseUint(strings.TrimSuffix(path.Base(key), manifestExt), 10, 64)
+	if err != nil {
+		return remoteSegment{}, fmt.Errorf("invalid manifest name. should be an integer: %s", key)
+	}
+	r, err := t.remote.Get(key)
+	if err != nil {
+		return remoteSegment{}, err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return remoteSegment{}, err
+	}
+	if len(b) != manifestWidthV1 || b[0] != manifestVersionV1 || binary.BigEndian.Uint64(b[1:]) != base {
+		return remoteSegment{}, fmt.Errorf("invalid segment manifest: %s", key)
+	}
+	return remoteSegment{
+		baseOffset:   base,
+		nextOffset:   binary.BigEndian.Uint64(b[1+offsetWidth:]),
+		size:         binary.BigEndian.Uint64(b[1+2*offsetWidth:]),
+		maxTimestamp: int64(binary.BigEndian.Uint64(b[1+3*offsetWidth:])),
+	}, nil
+}
+
+// holds reports whether offset is at or after the start of the offloaded segments.
+func (t *tiering) holds(offset uint64) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.segments) > 0 && offset >= t.segments[0].baseOffset
+}
+
+func (t *tiering) startOffset() (uint64, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.segments) == 0 {
+		return 0, false
+	}
+	return t.segments[0].baseOffset, true
+}
+
+func (t *tiering) size() uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var size uint64
+	for _, rs := range t.segments {
+		size += rs.size
+	}
+	return size
+}
+
+// segmentIndex returns the index of the last offloaded segment starting at or before offset, or -1.
+func (t *tiering) segmentIndex(offset uint64) int {
+	return sort.Search(len(t.segments), func(i int) bool {
+		return t.segments[i].baseOffset > offset
+	}) - 1
+}
+
+// read returns the first offloaded message at or after offset, or io.EOF when there is none.
+func (t *tiering) read(offset uint64) (*model.Msg, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i := max(t.segmentIndex(offset), 0); i < len(t.segments); i++ {
+		s, err := t.segment(t.segments[i].baseOffset)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := s.Read(offset)
+		if err != io.EOF {
+			return msg, err
+		}
+	}
+	return nil, io.EOF
+}
+
+// readRange is Segment.readRange across the offloaded segments.
+func (t *tiering) readRange(from uint64, maxMessages int, maxBytes, used uint64) ([]*model.Msg, uint64, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var msgs []*model.Msg
+	for i := max(t.segmentIndex(from), 0); i < len(t.segments); i++ {
+		s, err := t.segment(t.segments[i].baseOffset)
+		if err != nil {
+			return nil, used, err
+		}
+		var segMsgs []*model.Msg
+		segMsgs, used, err = s.readRange(from, maxMessages-len(msgs), maxBytes, used)
+		msgs = append(msgs, segMsgs...)
+		if err != io.EOF {
+			return msgs, used, err
+		}
+	}
+	return msgs, used, io.EOF
+}
+
+// offsetForTime returns the first offloaded offset whose message timestamp is at least ts.
+func (t *tiering) offsetForTime(ts int64) (uint64, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, rs := range t.segments {
+		if rs.maxTimestamp < ts {
+			continue
+		}
+		s, err := t.segment(rs.baseOffset)
+		if err != nil {
+			return 0, err
+		}
+		return s.OffsetForTime(ts)
+	}
+	return 0, io.EOF
+}
+
+// segment returns the local copy of an offloaded segment, fetching it on a cache miss. t.lock must be held.
+func (t *tiering) segment(base uint64) (*Segment, error) {
+	if s, ok := t.cache[base]; ok {
+		t.touch(base)
+		return s, nil
+	}
+
+	for _, ext := range tieredExts {
+		if err := t.fetch(t.key(base, ext), formatName(base, t.cacheDir, ext)); err != nil {
+			return nil, err
+		}
+	}
+	c := t.segCfg
+	c.StartOffset = base
+	s, err := newSegment(t.cacheDir, c, t.keys)
+	if err != nil {
+		return nil, err
+	}
+	t.cache[base] = s
+	t.lru = append(t.lru, base)
+
+	for len(t.lru) > max(t.cfg.MaxCachedSegments, 1) {
+		if err := t.evict(t.lru[0]); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (t *tiering) fetch(key, name string) error {
+	r, err := t.remote.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (t *tiering) touch(base uint64) {
+	for i, b := range t.lru {
+		if b == base {
+			t.lru = append(append(t.lru[:i:i], t.lru[i+1:]...), base)
+			return
+		}
+	}
+}
+
+// evict deletes the local copy of an offloaded segment. t.lock must be held.
+func (t *tiering) evict(base uint64) error {
+	s, ok := t.cache[base]
+	if !ok {
+		return nil
+	}
+	delete(t.cache, base)
+	for i, b := range t.lru {
+		if b == base {
+			t.lru = append(t.lru[:i], t.lru[i+1:]...)
+			break
+		}
+	}
+	return s.Remove()
+}
+
+// oldest returns the first offloaded segment.
+func (t *tiering) oldest() (remoteSegment, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.segments) == 0 {
+		return remoteSegment{}, false
+	}
+	return t.segments[0], true
+}
+
+// removeOldest deletes the first offloaded segment from the remote store, manifest first so an
+// interrupted removal never leaves a manifest behind without its files.
+func (t *tiering) removeOldest() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	base := t.segments[0].baseOffset
+	for _, ext := range append([]string{manifestExt}, tieredExts...) {
+		if err := t.remote.Delete(t.key(base, ext)); err != nil {
+			return err
+		}
+	}
+	if err := t.evict(base); err != nil {
+		return err
+	}
+	t.segments = t.segments[1:]
+	return nil
+}
+
+// close closes the fetched segments, their files are discarded the next time tiering is enabled.
+func (t *tiering) close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for base, s := range t.cache {
+		if err := s.Close(); err != nil {
+			return err
+		}
+		delete(t.cache, base)
+	}
+	t.lru = nil
+	return nil
+}
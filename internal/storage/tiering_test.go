@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/vandathron/bcaster/internal/cfg"
+	"github.com/vandathron/bcaster/internal/model"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirRemoteStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_remote")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	remote, err := NewDirRemoteStore(dir)
+	require.NoError(t, err)
+	require.NoError(t, remote.Put("part_a/0.message", strings.NewReader("first")))
+	require.NoError(t, remote.Put("part_a/10.message", strings.NewReader("second")))
+	require.NoError(t, remote.Put("part_b/0.message", strings.NewReader("other")))
+
+	keys, err := remote.List("part_a/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"part_a/0.message", "part_a/10.message"}, keys)
+
+	r, err := remote.Get("part_a/10.message")
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, "second", string(b))
+
+	require.NoError(t, remote.Delete("part_a/10.message"))
+	require.NoError(t, remote.Delete("part_a/10.message")) // deleting twice is fine
+	_, err = remote.Get("part_a/10.message")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestPartition_Tiering(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	remote, err := NewDirRemoteStore(filepath.Join(dir, "remote"))
+	require.NoError(t, err)
+	topic := "customer_created"
+	config := getPartitionConfig(filepath.Join(dir, "local"))
+	config.MaxMsgSizeByte = 1024
+	tierCfg := cfg.Tiering{
+		LocalRetention:    time.Minute,
+		CacheDir:          filepath.Join(dir, "cache"),
+		MaxCachedSegments: 2,
+	}
+
+	partition, err := NewPartition(topic, config)
+	require.NoError(t, err)
+	require.NoError(t, partition.EnableTiering(remote, tierCfg))
+	past := time.Now().Add(-time.Hour)
+	for i := 0; i < 100; i++ {
+		msg := getTestMsg(i)
+		msg.Timestamp = past.Add(time.Duration(i) * time.Second)
+		_, err := partition.Append(msg)
+		require.NoError(t, err)
+	}
+	segmentCnt := len(partition.segments)
+	require.Greater(t, segmentCnt, 3)
+
+	offloaded, err := partition.Offload()
+	require.NoError(t, err)
+	require.Equal(t, segmentCnt-1, offloaded) // everything but the writable segment
+	require.Equal(t, 1, len(partition.segments))
+	baseOffsets, err := segmentBaseOffsets(partition.Name())
+	require.NoError(t, err)
+	require.Equal(t, []uint64{partition.writableSegment.cfg.StartOffset}, baseOffsets)
+	require.Equal(t, uint64(0), partition.StartOffset())
+
+	checkReads := func(p *Partition) {
+		for i := 0; i < 100; i++ {
+			msg, err := p.Read(uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, getTestMsgByte(i), msg.Value)
+		}
+		require.LessOrEqual(t, len(p.tier.cache), tierCfg.MaxCachedSegments)
+
+		msgs, err := p.ReadRange(0, 100, 1024*1024) // spans offloaded and local segments
+		require.NoError(t, err)
+		require.Equal(t, 100, len(msgs))
+		for i, msg := range msgs {
+			require.Equal(t, uint64(i), msg.Offset)
+		}
+
+		off, err := p.OffsetForTime(past.Add(10 * time.Second))
+		require.NoError(t, err)
+		require.Equal(t, uint64(10), off)
+	}
+	checkReads(partition)
+	require.NoError(t, partition.Close())
+
+	partition, err = NewPartition(topic, config) // offloaded segments are found again after a restart
+	require.NoError(t, err)
+	defer partition.Close()
+	require.NoError(t, partition.EnableTiering(remote, tierCfg))
+	require.Equal(t, segmentCnt-1, len(partition.tier.segments))
+	checkReads(partition)
+
+	// retention deletes offloaded segments first
+	partition.cfg.RetentionByte = partition.tier.size()
+	deleted, err := partition.EnforceRetention()
+	require.NoError(t, err)
+	require.Greater(t, deleted, 0)
+	require.Equal(t, segmentCnt-1-deleted, len(partition.tier.segments))
+	require.Equal(t, partition.tier.segments[0].baseOffset, partition.StartOffset())
+	keys, err := remote.List("part_customer_created/")
+	require.NoError(t, err)
+	require.Equal(t, len(partition.tier.segments)*(len(tieredExts)+1), len(keys))
+
+	_, err = partition.Read(0)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+}
+
+func TestPartition_OffloadKeepsRecentSegments(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	remote, err := NewDirRemoteStore(filepath.Join(dir, "remote"))
+	require.NoError(t, err)
+	config := getPartitionConfig(filepath.Join(dir, "local"))
+	config.MaxMsgSizeByte = 1024
+
+	partition, err := NewPartition("customer_created", config)
+	require.NoError(t, err)
+	defer partition.Close()
+	_, err = partition.Offload()
+	require.ErrorIs(t, err, ErrTieringDisabled)
+
+	require.NoError(t, partition.EnableTiering(remote, cfg.Tiering{
+		LocalRetention: time.Hour,
+		CacheDir:       filepath.Join(dir, "cache"),
+	}))
+	for i := 0; i < 50; i++ {
+		_, _, err := partition.AppendBatch([]model.Msg{getTestMsg(i)})
+		require.NoError(t, err)
+	}
+	offloaded, err := partition.Offload()
+	require.NoError(t, err)
+	require.Equal(t, 0, offloaded)
+}
+
+func TestPartition_TieringCacheDir(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	remote, err := NewDirRemoteStore(filepath.Join(dir, "remote"))
+	require.NoError(t, err)
+	config := getPartitionConfig(filepath.Join(dir, "local"))
+
+	partition, err := NewPartition("customer_created", config)
+	require.NoError(t, err)
+	defer partition.Close()
+	_, err = partition.Append(getTestMsg(0))
+	require.NoError(t, err)
+
+	// a cache directory that would empty the partition's own is rejected
+	for _, cacheDir := range []string{"", config.Dir} {
+		require.Error(t, partition.EnableTiering(remote, cfg.Tiering{CacheDir: cacheDir}), cacheDir)
+	}
+	require.Nil(t, partition.tier)
+	msg, err := partition.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, getTestMsgByte(0), msg.Value)
+}
+
+func TestFileEngine_Tiering(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_engine")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := cfg.Store{
+		Consumer:  cfg.Consumer{Dir: filepath.Join(dir, "consumers"), MaxSizeByte: 1024},
+		Partition: getPartitionConfig(filepath.Join(dir, "partitions")),
+	}
+	for _, d := range []string{c.Consumer.Dir, c.Partition.Dir} {
+		require.NoError(t, os.MkdirAll(d, 0750))
+	}
+
+	engine, err := NewFileEngine(c)
+	require.NoError(t, err)
+	log, err := engine.OpenLog("customer_created-0")
+	require.NoError(t, err)
+	require.Nil(t, log.(*Partition).tier)
+	require.NoError(t, log.Close())
+	require.NoError(t, engine.Close())
+
+	c.Tiering = cfg.Tiering{RemoteDir: filepath.Join(dir, "remote"), CacheDir: filepath.Join(dir, "cache")}
+	engine, err = NewFileEngine(c)
+	require.NoError(t, err)
+	defer engine.Close()
+	log, err = engine.OpenLog("customer_created-0")
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.(*Partition).Offload()
+	require.NoError(t, err)
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"encoding/binary"
+	"github.com/tysonmote/gommap"
+	"github.com/vandathron/bcaster/internal/cfg"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	timeIndexEntryWidth = timestampWidth + offsetWidth // Full time index entry (unix ms timestamp and offset) by logic should occupy 16 bytes
+)
+
+// TimeIdx maps timestamps to offsets. An entry is only added when a message carries a timestamp greater than
+// every message before it, so entries are strictly increasing in both timestamp and offset.
+type TimeIdx struct {
+	file     *os.File
+	mmap     gommap.MMap
+	currSize uint64
+	cfg      cfg.Index
+	lock     sync.RWMutex // entries are only written by the partition's writer, readers take the read lock
+}
+
+func NewTimeIndex(fileName string, cfg cfg.Index) (*TimeIdx, error) {
+	idx := &TimeIdx{cfg: cfg}
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0666)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fInfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	idx.currSize = uint64(fInfo.Size())
+
+	// Attempts to truncate file size to max size specified as mmap attempts to map entire file to virtual address
+	err = f.Truncate(int64(idx.cfg.MaxSizeByte))
+	if err != nil {
+		return nil, err
+	}
+
+	idx.mmap, err = gommap.Map(f.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	idx.file = f
+	return idx, nil
+}
+
+// Append records that off is the first offset with a timestamp of at least ts. It is a no-op unless ts is
+// greater than the last indexed timestamp.
+func (i *TimeIdx) Append(ts int64, off uint64) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if lastTs, _, err := i.lastEntry(); err == nil && ts <= lastTs {
+		return nil
+	}
+
+	if timeIndexEntryWidth+i.currSize > i.cfg.MaxSizeByte {
+		return ErrSegmentFull
+	}
+
+	binary.BigEndian.PutUint64(i.mmap[i.currSize:i.currSize+timestampWidth], uint64(ts))
+	binary.BigEndian.PutUint64(i.mmap[i.currSize+timestampWidth:i.currSize+timeIndexEntryWidth], off)
+	i.currSize += timeIndexEntryWidth
+	return nil
+}
+
+// Sync flushes appended entries to stable storage.
+func (i *TimeIdx) Sync() error {
+	return i.mmap.Sync(gommap.MS_SYNC)
+}
+
+// Lookup returns the first offset whose message timestamp is at least ts.
+func (i *TimeIdx) Lookup(ts int64) (uint64, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	n := int(i.entryCount())
+	e := sort.Search(n, func(e int) bool {
+		entryTs, _ := i.entryAt(uint64(e))
+		return entryTs >= ts
+	})
+	if e == n {
+		return 0, io.EOF
+	}
+
+	_, off := i.entryAt(uint64(e))
+	return off, nil
+}
+
+func (i *TimeIdx) LastEntry() (ts int64, off uint64, err error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.lastEntry()
+}
+
+func (i *TimeIdx) lastEntry() (ts int64, off uint64, err error) {
+	if timeIndexEntryWidth > i.currSize { // Should have at least one entry
+		err = io.EOF
+		return
+	}
+
+	ts, off = i.entryAt(i.entryCount() - 1)
+	return ts, off, nil
+}
+
+func (i *TimeIdx) entryCount() uint64 {
+	return i.currSize / timeIndexEntryWidth
+}
+
+func (i *TimeIdx) entryAt(n uint64) (ts int64, off uint64) {
+	startPos := n * timeIndexEntryWidth
+	ts = int64(binary.BigEndian.Uint64(i.mmap[startPos : startPos+timestampWidth]))
+	off = binary.BigEndian.Uint64(i.mmap[startPos+timestampWidth : startPos+timeIndexEntryWidth])
+	return ts, off
+}
+
+// isConsistent reports whether every entry increases in both timestamp and offset over the previous one.
+func (i *TimeIdx) isConsistent() bool {
+	for e := uint64(1); e < i.entryCount(); e++ {
+		prevTs, prevOff := i.entryAt(e - 1)
+		ts, off := i.entryAt(e)
+		if ts <= prevTs || off <= prevOff {
+			return false
+		}
+	}
+	return true
+}
+
+// truncate drops every entry from the nth onwards, zeroing them so they cannot resurface after a crash.
+func (i *TimeIdx) truncate(n uint64) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	newSize := n * timeIndexEntryWidth
+	if newSize >= i.currSize {
+		return nil
+	}
+	clear(i.mmap[newSize:i.currSize])
+	i.currSize = newSize
+	return i.mmap.Sync(gommap.MS_SYNC)
+}
+
+func (i *TimeIdx) Close() error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil { // synchronously flush to file
+		return err
+	}
+	if err := i.mmap.UnsafeUnmap(); err != nil {
+		return err
+	}
+
+	if err := i.file.Truncate(int64(i.currSize)); err != nil {
+		return err
+	}
+
+	return i.file.Close()
+}
+
+// freeEntries returns how many more entries fit in the index.
+func (i *TimeIdx) freeEntries() uint64 {
+	if i.currSize >= i.cfg.MaxSizeByte {
+		return 0
+	}
+	return (i.cfg.MaxSizeByte - i.currSize) / timeIndexEntryWidth
+}
+
+func (i *TimeIdx) IsMaxedOut() bool {
+	return i.currSize+timeIndexEntryWidth > i.cfg.MaxSizeByte
+}
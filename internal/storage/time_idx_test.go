@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/vandathron/bcaster/internal/cfg"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestTimeIndex_AppendLookup(t *testing.T) {
+	file, err := os.CreateTemp("", "time_index_file_test")
+	require.NoError(t, err)
+	defer func(name string) {
+		file.Close()
+		os.Remove(name)
+	}(file.Name())
+
+	index, err := NewTimeIndex(file.Name(), cfg.Index{MaxSizeByte: 1024})
+	require.NoError(t, err)
+
+	require.NoError(t, index.Append(100, 0))
+	require.NoError(t, index.Append(100, 1)) // same timestamp is not indexed
+	require.NoError(t, index.Append(90, 2))  // out of order timestamp is not indexed
+	require.NoError(t, index.Append(200, 3))
+	require.NoError(t, index.Append(300, 4))
+	require.Equal(t, uint64(3*timeIndexEntryWidth), index.currSize)
+
+	for ts, expected := range map[int64]uint64{0: 0, 100: 0, 101: 3, 200: 3, 250: 4, 300: 4} {
+		off, err := index.Lookup(ts)
+		require.NoError(t, err)
+		require.Equal(t, expected, off, ts)
+	}
+	_, err = index.Lookup(301)
+	require.Equal(t, io.EOF, err)
+
+	ts, off, err := index.LastEntry()
+	require.NoError(t, err)
+	require.Equal(t, int64(300), ts)
+	require.Equal(t, uint64(4), off)
+	require.NoError(t, index.Close())
+
+	// reopen
+	index, err = NewTimeIndex(file.Name(), cfg.Index{MaxSizeByte: 1024})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3*timeIndexEntryWidth), index.currSize)
+	require.True(t, index.isConsistent())
+	require.NoError(t, index.Close())
+}
+
+func TestTimeIndex_Full(t *testing.T) {
+	file, err := os.CreateTemp("", "time_index_file_test")
+	require.NoError(t, err)
+	defer func(name string) {
+		file.Close()
+		os.Remove(name)
+	}(file.Name())
+
+	index, err := NewTimeIndex(file.Name(), cfg.Index{MaxSizeByte: 2 * timeIndexEntryWidth})
+	require.NoError(t, err)
+	require.NoError(t, index.Append(1, 0))
+	require.NoError(t, index.Append(2, 1))
+	require.True(t, index.IsMaxedOut())
+	require.Equal(t, ErrSegmentFull, index.Append(3, 2))
+	require.NoError(t, index.Close())
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	topicMetaVersionV1       = byte(1)
+	topicMetaPartitionsWidth = 4
+	topicMetaWidthV1         = metaVersionWidth + topicMetaPartitionsWidth
+)
+
+// TopicMeta holds the properties of a topic shared by its partitions.
+type TopicMeta struct {
+	Partitions int
+}
+
+// PartitionName returns the name partition n of topic is stored under, to be passed to NewPartition.
+func PartitionName(topic string, n int) string {
+	return fmt.Sprintf("%s-%d", topic, n)
+}
+
+func topicMetaPath(dir, topic string) string {
+	return filepath.Join(dir, fmt.Sprintf("topic_%s.meta", topic))
+}
+
+// migrationMarkerPath returns the file marking the legacy log of topic as being migrated to its partition 0.
+func migrationMarkerPath(dir, topic string) string {
+	return filepath.Join(dir, fmt.Sprintf("topic_%s.migrating", topic))
+}
+
+// readTopics returns the topics with a meta file in dir, sorted.
+func readTopics(dir string) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var topics []string
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, "topic_") || !strings.HasSuffix(name, ".meta") {
+			continue
+		}
+		topics = append(topics, strings.TrimSuffix(strings.TrimPrefix(name, "topic_"), ".meta"))
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// readTopicMeta reads the meta file of topic in dir. An error satisfying errors.Is(err, os.ErrNotExist) is
+// returned for a topic that was never created.
+func readTopicMeta(dir, topic string) (TopicMeta, error) {
+	name := topicMetaPath(dir, topic)
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return TopicMeta{}, err
+	}
+	if len(b) < topicMetaWidthV1 || b[0] != topicMetaVersionV1 {
+		return TopicMeta{}, fmt.Errorf("invalid topic meta file: %s", name)
+	}
+	return TopicMeta{Partitions: int(binary.BigEndian.Uint32(b[metaVersionWidth:topicMetaWidthV1]))}, nil
+}
+
+// writeTopicMeta replaces the meta file of topic in dir atomically.
+func writeTopicMeta(dir, topic string, m TopicMeta) error {
+	if m.Partitions <= 0 {
+		return fmt.Errorf("topic should have at least one partition: %d", m.Partitions)
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	b := make([]byte, topicMetaWidthV1)
+	b[0] = topicMetaVersionV1
+	binary.BigEndian.PutUint32(b[metaVersionWidth:], uint32(m.Partitions))
+	return writeFileAtomic(topicMetaPath(dir, topic), b)
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"github.com/vandathron/bcaster/internal/model"
+)
+
+// WriteMarker ends producer's open transaction with a commit or abort marker, once the marker is as durable
+// as the sync policy requires. Nothing is written when the producer has no open transaction, so ending a
+// transaction again after a crash is harmless.
+func (p *Partition) WriteMarker(producer model.Producer, control model.Control) error {
+	p.lock.Lock()
+	open, err := p.producers.checkMarker(producer, control)
+	if err != nil || !open {
+		p.lock.Unlock()
+		return err
+	}
+	marker := markerMsg(producer, control)
+	marker.Offset, err = p.append(marker)
+	if err == nil {
+		p.producersLock.Lock()
+		p.producers.update(marker)
+		p.producersLock.Unlock()
+	}
+	segment := p.writableSegment
+	p.lock.Unlock()
+	p.notifyAppend()
+	if err != nil {
+		return err
+	}
+	return segment.waitDurable(marker.Offset)
+}
+
+// LastStableOffset returns the offset of the first message of the oldest open transaction, or the high
+// watermark when no transaction is open. Read-committed consumers read no further.
+func (p *Partition) LastStableOffset() uint64 {
+	hwm := p.HighWatermark()
+	p.producersLock.RLock()
+	defer p.producersLock.RUnlock()
+	return p.producers.firstOpenOffset(hwm)
+}
+
+// Aborted reports whether msg, read from the partition, belongs to an aborted transaction.
+func (p *Partition) Aborted(msg *model.Msg) bool {
+	p.producersLock.RLock()
+	defer p.producersLock.RUnlock()
+	return p.producers.isAborted(msg)
+}
+
+// pruneAborted forgets the aborted transactions that ended before offset, once their messages were removed.
+func (p *Partition) pruneAborted(offset uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.producersLock.Lock()
+	defer p.producersLock.Unlock()
+	p.producers.prune(offset)
+}
+
+func markerMsg(producer model.Producer, control model.Control) model.Msg {
+	producer.Sequence = -1 // markers do not take a sequence number
+	return model.Msg{Producer: producer, Control: control}
+}
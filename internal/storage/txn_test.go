@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/vandathron/bcaster/internal/model"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPartition_Transactions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topic := "orders"
+	config := getPartitionConfig(dir)
+
+	partition, err := NewPartition(topic, config)
+	require.NoError(t, err)
+	committer, aborter := model.Producer{ID: 1}, model.Producer{ID: 2}
+	txnMsgs := func(from, n int) []model.Msg {
+		var msgs []model.Msg
+		for i := from; i < from+n; i++ {
+			msg := getTestMsg(i)
+			msg.Transactional = true
+			msgs = append(msgs, msg)
+		}
+		return msgs
+	}
+
+	_, err = partition.Append(getTestMsg(0))
+	require.NoError(t, err)
+	_, _, err = partition.AppendIdempotent(committer, txnMsgs(1, 2)) // offsets 1-2
+	require.NoError(t, err)
+	_, _, err = partition.AppendIdempotent(aborter, txnMsgs(3, 2)) // offsets 3-4
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), partition.LastStableOffset())
+
+	require.NoError(t, partition.WriteMarker(aborter, model.ControlAbort)) // offset 5
+	require.Equal(t, uint64(1), partition.LastStableOffset())
+	require.NoError(t, partition.WriteMarker(committer, model.ControlCommit)) // offset 6
+	require.Equal(t, partition.HighWatermark(), partition.LastStableOffset())
+	require.NoError(t, partition.WriteMarker(committer, model.ControlCommit)) // no open transaction, nothing written
+	require.Equal(t, uint64(7), partition.HighWatermark())
+
+	marker, err := partition.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, model.ControlAbort, marker.Control)
+	require.Equal(t, aborter.ID, marker.Producer.ID)
+
+	require.Error(t, partition.WriteMarker(committer, model.ControlNone))
+
+	// a transaction left open and the aborted one survive a restart, with and without a snapshot
+	committer.Sequence = 2
+	_, _, err = partition.AppendIdempotent(committer, txnMsgs(7, 1)) // offset 7
+	require.NoError(t, err)
+	require.NoError(t, partition.Close())
+	for _, removeSnapshot := range []bool{false, true} {
+		if removeSnapshot {
+			require.NoError(t, os.Remove(filepath.Join(partition.Name(), producerSnapshotFile)))
+		}
+		partition, err = NewPartition(topic, config)
+		require.NoError(t, err)
+		require.Equal(t, uint64(7), partition.LastStableOffset())
+		for off, aborted := range map[uint64]bool{0: false, 1: false, 3: true, 4: true, 7: false} {
+			msg, err := partition.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, aborted, partition.Aborted(msg), "offset %d", off)
+		}
+		require.NoError(t, partition.Close())
+	}
+
+	// an older epoch cannot end a newer epoch's transaction
+	partition, err = NewPartition(topic, config)
+	require.NoError(t, err)
+	defer partition.Close()
+	_, _, err = partition.AppendIdempotent(model.Producer{ID: 1, Epoch: 1}, txnMsgs(8, 1))
+	require.NoError(t, err)
+	require.ErrorIs(t, partition.WriteMarker(committer, model.ControlAbort), ErrProducerFenced)
+	require.NoError(t, partition.WriteMarker(model.Producer{ID: 1, Epoch: 1}, model.ControlCommit))
+	require.Equal(t, partition.HighWatermark(), partition.LastStableOffset())
+
+	// readers of transaction state do not wait for a writer
+	partition.lock.Lock()
+	defer partition.lock.Unlock()
+	done := make(chan bool)
+	go func() {
+		msg, _ := partition.Read(3)
+		done <- partition.LastStableOffset() == partition.HighWatermark() && partition.Aborted(msg)
+	}()
+	select {
+	case ok := <-done:
+		require.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("reading transaction state waited for the writer lock")
+	}
+}
+
+func TestPartition_PruneAborted(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := getPartitionConfig(dir)
+	config.MaxMsgSizeByte = 1024
+	config.RetentionByte = 1024 * 3
+
+	partition, err := NewPartition("orders", config)
+	require.NoError(t, err)
+	defer partition.Close()
+	producer := model.Producer{ID: 1}
+	for i := 0; i < 40; i++ {
+		msg := getTestMsg(i)
+		msg.Transactional = true
+		producer.Sequence = int32(i)
+		_, _, err = partition.AppendIdempotent(producer, []model.Msg{msg})
+		require.NoError(t, err)
+		require.NoError(t, partition.WriteMarker(producer, model.ControlAbort))
+	}
+	require.Len(t, partition.producers.aborted[1], 40)
+	requireAbortedFrom := func(offset uint64) {
+		aborted := partition.producers.aborted[1]
+		require.NotEmpty(t, aborted)
+		require.Less(t, len(aborted), 40)
+		require.GreaterOrEqual(t, aborted[0].lastOffset, offset)
+		require.Less(t, aborted[0].firstOffset, offset+2)
+	}
+
+	// retention forgets the transactions it deleted
+	deleted, err := partition.EnforceRetention()
+	require.NoError(t, err)
+	require.Greater(t, deleted, 0)
+	requireAbortedFrom(partition.StartOffset())
+
+	// compaction forgets the transactions whose messages it removed
+	_, err = partition.Compact()
+	require.NoError(t, err)
+	start := partition.writableSegment.cfg.StartOffset
+	requireAbortedFrom(start)
+	msg, err := partition.Read(start + start%2) // a message rather than a marker
+	require.NoError(t, err)
+	require.True(t, partition.Aborted(msg))
+}
@@ -0,0 +1,39 @@
+package storage
+
+import "context"
+
+// HighWatermark returns the offset the next appended message will be readable at.
+func (p *Partition) HighWatermark() uint64 {
+	p.segLock.RLock()
+	defer p.segLock.RUnlock()
+	return p.writableSegment.flushedOffset.Load()
+}
+
+// WaitForOffset blocks until the message at offset has been appended, ctx is done or the partition is
+// closed. A message at offset may since have been removed by compaction, in which case Read returns the next.
+func (p *Partition) WaitForOffset(ctx context.Context, offset uint64) error {
+	for {
+		p.notifyLock.Lock()
+		appended := p.appended // taken before checking so an append in between is not missed
+		p.notifyLock.Unlock()
+
+		if p.HighWatermark() > offset {
+			return nil
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.stop:
+			return ErrPartitionClosed
+		}
+	}
+}
+
+// notifyAppend wakes every reader waiting for new messages.
+func (p *Partition) notifyAppend() {
+	p.notifyLock.Lock()
+	defer p.notifyLock.Unlock()
+	close(p.appended)
+	p.appended = make(chan struct{})
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPartition_WaitForOffset(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_partition")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	partition, err := NewPartition("customer_created", getPartitionConfig(dir))
+	require.NoError(t, err)
+	_, err = partition.Append(getTestMsg(0))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), partition.HighWatermark())
+
+	// an offset already appended does not block
+	require.NoError(t, partition.WaitForOffset(context.Background(), 0))
+
+	woken := make(chan error)
+	go func() {
+		woken <- partition.WaitForOffset(context.Background(), 1)
+	}()
+	select {
+	case err := <-woken:
+		t.Fatalf("woke before the offset was appended: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	_, err = partition.Append(getTestMsg(1))
+	require.NoError(t, err)
+	require.NoError(t, <-woken)
+	msg, err := partition.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), msg.Offset)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, partition.WaitForOffset(ctx, 5), context.DeadlineExceeded)
+
+	go func() {
+		woken <- partition.WaitForOffset(context.Background(), 5)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, partition.Close())
+	require.ErrorIs(t, <-woken, ErrPartitionClosed)
+}